@@ -33,6 +33,10 @@ func emulate(cfg config.Config) {
 	go terminator.ReapZombies(ctx)
 	var wg sync.WaitGroup
 
+	if cfg.Debug {
+		log.Printf("debug mode: running a single Lambda process without deadline: %s %v", cfg.CommandName, cfg.CommandArgs)
+	}
+
 	invocationCh := make(chan invocation.Invocation, cfg.QueueSize)
 
 	wg.Add(1)
@@ -42,6 +46,7 @@ func emulate(cfg config.Config) {
 	for i := range cfg.MaxConcurrency {
 		processCfgs[i] = manager.ProcessConfig{
 			ID:    fmt.Sprintf("pid-%d", i+1),
+			Index: int(i),
 			Start: i < cfg.InitialConcurrency,
 		}
 	}
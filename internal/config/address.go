@@ -30,3 +30,12 @@ func (a ListenAddress) AwsLambdaRuntimeAPI() string {
 
 	return fmt.Sprintf("localhost:%s", portStr)
 }
+
+func (a ListenAddress) Port() string {
+	_, portStr, err := net.SplitHostPort(string(a))
+	if err != nil {
+		panic(fmt.Sprintf("could not extract host and port from %s", a))
+	}
+
+	return portStr
+}
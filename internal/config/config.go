@@ -3,7 +3,10 @@ package config
 import (
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -12,6 +15,7 @@ type Config struct {
 	CommandName                     string
 	CommandArgs                     []string
 	OriginalEnvironment             []string
+	ExtraEnvironment                []string
 	OriginalAWSLambdaRuntimeAPI     string
 	MaxConcurrency                  uint32
 	InitialConcurrency              uint32
@@ -24,9 +28,34 @@ type Config struct {
 	DelayBetweenHandleAttempts      time.Duration
 	RAPIServerShutdownTimeout       time.Duration
 	ProcessShutdownTimeout          time.Duration
+	ProcessRestartDelay             time.Duration
+	ProcessMaxRestartDelay          time.Duration
+	ProcessMaxFailures              int
+	MaxInvocationsPerEnv            uint32
+	MaxEnvLifetime                  time.Duration
+	FreezeIdle                      bool
 	LambdaRuntimeDeadline           time.Duration
+	LambdaInitTimeout               time.Duration
 	LambdaRuntimeInvokedFunctionArn string
+	LambdaCognitoIdentity           string
+	LambdaMemorySize                uint32
+	LambdaHandler                   string
+	LambdaRegion                    string
+	LambdaTaskRoot                  string
+	EnforceMemorySize               bool
+	ThrottleCPU                     bool
+	RunAs                           *User
+	EphemeralStorageSize            uint32
 	MaxBodySize                     int64
+	MaxStreamingBodySize            int64
+	LegacyFunctionErrors            bool
+	ExtensionsDir                   string
+	ExtensionShutdownTimeout        time.Duration
+	WatchPaths                      []string
+	WatchInterval                   time.Duration
+	Debug                           bool
+	DebugWrapper                    []string
+	DebugWaitForDebugger            bool
 }
 
 const (
@@ -42,9 +71,37 @@ const (
 	CRIE_DELAY_BETWEEN_HANDLE_ATTEMPTS       = "CRIE_DELAY_BETWEEN_HANDLE_ATTEMPTS"
 	CRIE_RAPI_SERVER_SHUTDOWN_TIMEOUT        = "CRIE_RAPI_SERVER_SHUTDOWN_TIMEOUT"
 	CRIE_PROCESS_SHUTDOWN_TIMEOUT            = "CRIE_PROCESS_SHUTDOWN_TIMEOUT"
+	CRIE_PROCESS_RESTART_DELAY               = "CRIE_PROCESS_RESTART_DELAY"
+	CRIE_PROCESS_MAX_RESTART_DELAY           = "CRIE_PROCESS_MAX_RESTART_DELAY"
+	CRIE_PROCESS_MAX_FAILURES                = "CRIE_PROCESS_MAX_FAILURES"
+	CRIE_MAX_INVOCATIONS_PER_ENV             = "CRIE_MAX_INVOCATIONS_PER_ENV"
+	CRIE_MAX_ENV_LIFETIME                    = "CRIE_MAX_ENV_LIFETIME"
+	CRIE_FREEZE_IDLE                         = "CRIE_FREEZE_IDLE"
 	CRIE_LAMBDA_RUNTIME_DEADLINE             = "CRIE_LAMBDA_RUNTIME_DEADLINE"
+	CRIE_LAMBDA_INIT_TIMEOUT                 = "CRIE_LAMBDA_INIT_TIMEOUT"
 	CRIE_LAMBDA_RUNTIME_INVOKED_FUNCTION_ARN = "CRIE_LAMBDA_RUNTIME_INVOKED_FUNCTION_ARN"
+	CRIE_LAMBDA_COGNITO_IDENTITY             = "CRIE_LAMBDA_COGNITO_IDENTITY"
+	CRIE_LAMBDA_MEMORY_SIZE                  = "CRIE_LAMBDA_MEMORY_SIZE"
+	CRIE_LAMBDA_HANDLER                      = "CRIE_LAMBDA_HANDLER"
+	CRIE_LAMBDA_REGION                       = "CRIE_LAMBDA_REGION"
+	CRIE_LAMBDA_TASK_ROOT                    = "CRIE_LAMBDA_TASK_ROOT"
+	LAMBDA_TASK_ROOT                         = "LAMBDA_TASK_ROOT"
+	AWS_REGION                               = "AWS_REGION"
+	AWS_DEFAULT_REGION                       = "AWS_DEFAULT_REGION"
+	CRIE_THROTTLE_CPU                        = "CRIE_THROTTLE_CPU"
+	CRIE_RUN_AS                              = "CRIE_RUN_AS"
+	CRIE_EPHEMERAL_STORAGE_SIZE              = "CRIE_EPHEMERAL_STORAGE_SIZE"
 	CRIE_MAX_BODY_SIZE                       = "CRIE_MAX_BODY_SIZE"
+	CRIE_MAX_STREAMING_BODY_SIZE             = "CRIE_MAX_STREAMING_BODY_SIZE"
+	CRIE_LEGACY_FUNCTION_ERRORS              = "CRIE_LEGACY_FUNCTION_ERRORS"
+	CRIE_EXTENSIONS_DIR                      = "CRIE_EXTENSIONS_DIR"
+	CRIE_EXTENSION_SHUTDOWN_TIMEOUT          = "CRIE_EXTENSION_SHUTDOWN_TIMEOUT"
+	CRIE_ENV_PREFIX                          = "CRIE_ENV_"
+	CRIE_WATCH_PATHS                         = "CRIE_WATCH_PATHS"
+	CRIE_WATCH_INTERVAL                      = "CRIE_WATCH_INTERVAL"
+	CRIE_DEBUG                               = "CRIE_DEBUG"
+	CRIE_DEBUG_WRAPPER                       = "CRIE_DEBUG_WRAPPER"
+	CRIE_DEBUG_WAIT_FOR_DEBUGGER             = "CRIE_DEBUG_WAIT_FOR_DEBUGGER"
 
 	defaultMaxConcurrency                 uint32        = 2
 	defaultInitialConcurrency             uint32        = 1
@@ -57,9 +114,31 @@ const (
 	defaultDelayBetweenHandleAttempts     time.Duration = 100 * time.Millisecond
 	defaultRAPIServerShutdownTimeout      time.Duration = 9 * time.Second
 	defaultProcessShutdownTimeout         time.Duration = 5 * time.Second
+	defaultProcessRestartDelay            time.Duration = 100 * time.Millisecond
+	defaultProcessMaxRestartDelay         time.Duration = 10 * time.Second
+	defaultProcessMaxFailures             int           = 5
+	defaultMaxInvocationsPerEnv           uint32        = 0
+	defaultMaxEnvLifetime                 time.Duration = 0
+	defaultFreezeIdle                     bool          = false
 	defaultLambdaRuntimeDeadline          time.Duration = 90 * time.Second
+	defaultLambdaInitTimeout              time.Duration = 10 * time.Second
 	defaultLambdaRuntimeInvokedFunctionArn string        = "arn:aws:lambda:us-east-2:123456789012:function:custom-runtime"
+	defaultLambdaMemorySize               uint32        = 128
+	defaultLambdaRegion                   string        = "us-east-1"
+	defaultThrottleCPU                    bool          = false
+	defaultEphemeralStorageSize           uint32        = 512
 	defaultMaxBodySize                    int64         = 6 * 1024 * 1024 // 6 MB — AWS Lambda payload limit
+	defaultMaxStreamingBodySize           int64         = 20 * 1024 * 1024 // 20 MB — AWS Lambda streamed response limit
+	defaultLegacyFunctionErrors           bool          = false
+	defaultExtensionsDir                  string        = "/opt/extensions"
+	defaultExtensionShutdownTimeout       time.Duration = 2 * time.Second
+	defaultWatchInterval                  time.Duration = 500 * time.Millisecond
+	defaultDebug                          bool          = false
+	defaultDebugWaitForDebugger           bool          = false
+
+	// debugTimeout replaces the deadline and the init timeout in debug mode,
+	// long enough to step through a handler.
+	debugTimeout time.Duration = 24 * time.Hour
 )
 
 func Detect() (Config, error) {
@@ -73,6 +152,7 @@ func Detect() (Config, error) {
 	cfg.CommandArgs = os.Args[2:]
 
 	cfg.OriginalEnvironment = os.Environ()
+	cfg.ExtraEnvironment = extraEnvironment(cfg.OriginalEnvironment)
 
 	cfg.OriginalAWSLambdaRuntimeAPI, _ = os.LookupEnv(AWS_LAMBDA_RUNTIME_API)
 
@@ -137,6 +217,36 @@ func Detect() (Config, error) {
 		return cfg, fmt.Errorf("process shutdown timeout (%s) must be lower than rapi.server shutdown timeout (%s)", cfg.ProcessShutdownTimeout, cfg.RAPIServerShutdownTimeout)
 	}
 
+	cfg.ProcessRestartDelay, err = parseEnv(CRIE_PROCESS_RESTART_DELAY, defaultProcessRestartDelay, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ProcessMaxRestartDelay, err = parseEnv(CRIE_PROCESS_MAX_RESTART_DELAY, defaultProcessMaxRestartDelay, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ProcessMaxFailures, err = parseEnvInt(CRIE_PROCESS_MAX_FAILURES, defaultProcessMaxFailures)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxInvocationsPerEnv, err = parseEnvUint32(CRIE_MAX_INVOCATIONS_PER_ENV, defaultMaxInvocationsPerEnv)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxEnvLifetime, err = parseEnv(CRIE_MAX_ENV_LIFETIME, defaultMaxEnvLifetime, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.FreezeIdle, err = parseEnvBool(CRIE_FREEZE_IDLE, defaultFreezeIdle)
+	if err != nil {
+		return cfg, err
+	}
+
 	cfg.LambdaRuntimeDeadline, err = parseEnv(CRIE_LAMBDA_RUNTIME_DEADLINE, defaultLambdaRuntimeDeadline, time.ParseDuration)
 	if err != nil {
 		return cfg, err
@@ -146,12 +256,208 @@ func Detect() (Config, error) {
 		return cfg, fmt.Errorf("lambda runtime deadline cannot be higher than 15 minutes, but it was %s", cfg.LambdaRuntimeDeadline)
 	}
 
+	cfg.LambdaInitTimeout, err = parseEnv(CRIE_LAMBDA_INIT_TIMEOUT, defaultLambdaInitTimeout, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
 	cfg.LambdaRuntimeInvokedFunctionArn = getEnv(CRIE_LAMBDA_RUNTIME_INVOKED_FUNCTION_ARN, defaultLambdaRuntimeInvokedFunctionArn)
 
+	cfg.LambdaCognitoIdentity, err = parseEnvJSONObject(CRIE_LAMBDA_COGNITO_IDENTITY, "")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.LambdaMemorySize, err = parseEnvUint32(CRIE_LAMBDA_MEMORY_SIZE, defaultLambdaMemorySize)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.LambdaMemorySize < 128 || cfg.LambdaMemorySize > 10240 {
+		return cfg, fmt.Errorf("lambda memory size must be between 128 and 10240 MB, but it was %d", cfg.LambdaMemorySize)
+	}
+
+	cfg.LambdaHandler = getEnv(CRIE_LAMBDA_HANDLER, defaultLambdaHandler(cfg))
+	cfg.LambdaRegion = getEnv(CRIE_LAMBDA_REGION, lambdaRegion(cfg.LambdaRuntimeInvokedFunctionArn))
+
+	cfg.LambdaTaskRoot, err = lambdaTaskRoot()
+	if err != nil {
+		return cfg, err
+	}
+
+	// The memory is limited only when its size is configured, as the default
+	// would kill the functions which ran fine before limits were introduced.
+	_, cfg.EnforceMemorySize = os.LookupEnv(CRIE_LAMBDA_MEMORY_SIZE)
+
+	cfg.ThrottleCPU, err = parseEnvBool(CRIE_THROTTLE_CPU, defaultThrottleCPU)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RunAs, err = parseEnvUser(CRIE_RUN_AS)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.EphemeralStorageSize, err = parseEnvUint32(CRIE_EPHEMERAL_STORAGE_SIZE, defaultEphemeralStorageSize)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.EphemeralStorageSize < 512 || cfg.EphemeralStorageSize > 10240 {
+		return cfg, fmt.Errorf("ephemeral storage size must be between 512 and 10240 MB, but it was %d", cfg.EphemeralStorageSize)
+	}
+
 	cfg.MaxBodySize, err = parseEnvInt64(CRIE_MAX_BODY_SIZE, defaultMaxBodySize)
 	if err != nil {
 		return cfg, err
 	}
 
+	cfg.MaxStreamingBodySize, err = parseEnvInt64(CRIE_MAX_STREAMING_BODY_SIZE, defaultMaxStreamingBodySize)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.LegacyFunctionErrors, err = parseEnvBool(CRIE_LEGACY_FUNCTION_ERRORS, defaultLegacyFunctionErrors)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ExtensionsDir = getEnv(CRIE_EXTENSIONS_DIR, defaultExtensionsDir)
+
+	cfg.ExtensionShutdownTimeout, err = parseEnv(CRIE_EXTENSION_SHUTDOWN_TIMEOUT, defaultExtensionShutdownTimeout, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.WatchPaths = watchPaths(getEnv(CRIE_WATCH_PATHS, ""))
+
+	cfg.WatchInterval, err = parseEnv(CRIE_WATCH_INTERVAL, defaultWatchInterval, time.ParseDuration)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.WatchInterval <= 0 {
+		return cfg, fmt.Errorf("watch interval must be positive, but it was %s", cfg.WatchInterval)
+	}
+
+	cfg.Debug, err = parseEnvBool(CRIE_DEBUG, defaultDebug)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.DebugWaitForDebugger, err = parseEnvBool(CRIE_DEBUG_WAIT_FOR_DEBUGGER, defaultDebugWaitForDebugger)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.Debug {
+		if err := applyDebug(&cfg); err != nil {
+			return cfg, err
+		}
+	}
+
 	return cfg, nil
 }
+
+// applyDebug runs a single Lambda process without deadlines, so a debugger
+// can stop the function for as long as needed, optionally starting the
+// command under the wrapper given in CRIE_DEBUG_WRAPPER. Freezing and
+// retiring the execution environment are turned off, as they would suspend or
+// kill the process being debugged.
+func applyDebug(cfg *Config) error {
+	cfg.MaxConcurrency = 1
+	cfg.InitialConcurrency = min(cfg.InitialConcurrency, 1)
+	cfg.MaxHandleAttempts = math.MaxUint32
+	cfg.LambdaRuntimeDeadline = debugTimeout
+	cfg.LambdaInitTimeout = debugTimeout
+	cfg.FreezeIdle = false
+	cfg.MaxInvocationsPerEnv = 0
+	cfg.MaxEnvLifetime = 0
+
+	cfg.DebugWrapper = strings.Fields(getEnv(CRIE_DEBUG_WRAPPER, ""))
+	if len(cfg.DebugWrapper) > 0 {
+		// The wrapper traces the runtime from its start, so waiting for a
+		// debugger to trace it would never hold back an invocation.
+		if cfg.DebugWaitForDebugger {
+			return fmt.Errorf("%s cannot be used with %s, the wrapper traces the runtime already", CRIE_DEBUG_WAIT_FOR_DEBUGGER, CRIE_DEBUG_WRAPPER)
+		}
+
+		cfg.CommandArgs = slices.Concat(cfg.DebugWrapper[1:], []string{cfg.CommandName}, cfg.CommandArgs)
+		cfg.CommandName = cfg.DebugWrapper[0]
+	}
+
+	return nil
+}
+
+// defaultLambdaHandler follows the convention of the Lambda base images, where
+// the handler is the last argument of the command.
+func defaultLambdaHandler(cfg Config) string {
+	if len(cfg.CommandArgs) > 0 {
+		return cfg.CommandArgs[len(cfg.CommandArgs)-1]
+	}
+
+	return cfg.CommandName
+}
+
+// lambdaRegion keeps the region already configured for the AWS SDKs, and falls
+// back to the region of the function ARN.
+func lambdaRegion(arn string) string {
+	for _, key := range []string{AWS_REGION, AWS_DEFAULT_REGION} {
+		if region := os.Getenv(key); region != "" {
+			return region
+		}
+	}
+
+	return regionOf(arn)
+}
+
+// regionOf returns the region of a function ARN, like
+// arn:aws:lambda:us-east-2:123456789012:function:name.
+func regionOf(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 4 || parts[3] == "" {
+		return defaultLambdaRegion
+	}
+
+	return parts[3]
+}
+
+// lambdaTaskRoot keeps the task root set by the image, like the Lambda base
+// images do, and falls back to the working directory.
+func lambdaTaskRoot() (string, error) {
+	if root, found := os.LookupEnv(CRIE_LAMBDA_TASK_ROOT); found {
+		return root, nil
+	}
+
+	if root, found := os.LookupEnv(LAMBDA_TASK_ROOT); found {
+		return root, nil
+	}
+
+	return os.Getwd()
+}
+
+// extraEnvironment returns the variables passed to the Lambda processes
+// through CRIE_ENV_*, with the prefix removed.
+func extraEnvironment(environment []string) []string {
+	var env []string
+	for _, variable := range environment {
+		if name, found := strings.CutPrefix(variable, CRIE_ENV_PREFIX); found && !strings.HasPrefix(name, "=") {
+			env = append(env, name)
+		}
+	}
+
+	return env
+}
+
+// watchPaths splits the comma separated list of paths to watch.
+func watchPaths(value string) []string {
+	var paths []string
+	for path := range strings.SplitSeq(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
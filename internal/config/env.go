@@ -1,6 +1,8 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"net"
 	"os"
 	"strconv"
@@ -51,6 +53,10 @@ func parseEnvInt64(key string, defaultValue int64) (int64, error) {
 	})
 }
 
+func parseEnvBool(key string, defaultValue bool) (bool, error) {
+	return parseEnv(key, defaultValue, strconv.ParseBool)
+}
+
 func parseEnvListenAddress(key string, defaultValue ListenAddress) (ListenAddress, error) {
 	return parseEnv(key, defaultValue, func(valueStr string) (ListenAddress, error) {
 		_, _, err := net.SplitHostPort(valueStr)
@@ -61,3 +67,14 @@ func parseEnvListenAddress(key string, defaultValue ListenAddress) (ListenAddres
 		return ListenAddress(valueStr), nil
 	})
 }
+
+func parseEnvJSONObject(key string, defaultValue string) (string, error) {
+	return parseEnv(key, defaultValue, func(valueStr string) (string, error) {
+		var object map[string]any
+		if err := json.Unmarshal([]byte(valueStr), &object); err != nil || object == nil {
+			return "", fmt.Errorf("%s must be a JSON object, but it was %s", key, valueStr)
+		}
+
+		return valueStr, nil
+	})
+}
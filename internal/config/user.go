@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// User is the account the Lambda processes run as.
+type User struct {
+	Name string
+	UID  uint32
+	GID  uint32
+}
+
+// parseEnvUser resolves a user name or numeric id, optionally followed by a
+// group name or numeric id after a colon, like 1000:1000 or sbx_user1051.
+func parseEnvUser(key string) (*User, error) {
+	return parseEnv(key, nil, func(valueStr string) (*User, error) {
+		userStr, groupStr, hasGroup := strings.Cut(valueStr, ":")
+
+		u, err := lookupUser(userStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		if hasGroup {
+			u.GID, err = lookupGroup(groupStr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+
+		if euid := os.Geteuid(); euid != 0 && uint32(euid) != u.UID {
+			return nil, fmt.Errorf("%s: running processes as %s requires root", key, valueStr)
+		}
+
+		return u, nil
+	})
+}
+
+func lookupUser(name string) (*User, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u := &User{Name: name, UID: uint32(uid), GID: uint32(uid)}
+		if account, err := user.LookupId(name); err == nil {
+			u.Name = account.Username
+			u.GID, err = parseID(account.Gid)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return u, nil
+	}
+
+	account, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, err := parseID(account.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := parseID(account.Gid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{Name: account.Username, UID: uid, GID: gid}, nil
+}
+
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseID(group.Gid)
+}
+
+func parseID(id string) (uint32, error) {
+	value, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported id %s: %w", id, err)
+	}
+
+	return uint32(value), nil
+}
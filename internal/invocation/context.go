@@ -0,0 +1,61 @@
+package invocation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	XAmzClientContext = "X-Amz-Client-Context"
+
+	// MaxClientContextSize is the AWS limit of the base64 encoded client
+	// context.
+	MaxClientContextSize = 3583
+
+	ErrorTypeInvalidRequestContent = "InvalidRequestContentException"
+)
+
+// RequestError reports an invocation request rejected because of the
+// client, mapped to HTTP 400 with the error type in X-Amzn-ErrorType.
+type RequestError struct {
+	Type    string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Message)
+}
+
+// ClientContext decodes the base64 encoded JSON client context sent by mobile
+// SDK style callers. The runtime receives it decoded.
+func ClientContext(encoded string) (string, error) {
+	if encoded == "" {
+		return "", nil
+	}
+
+	if len(encoded) > MaxClientContextSize {
+		return "", &RequestError{
+			Type:    ErrorTypeInvalidRequestContent,
+			Message: fmt.Sprintf("client context must not be longer than %d bytes, but it was %d", MaxClientContextSize, len(encoded)),
+		}
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", &RequestError{
+			Type:    ErrorTypeInvalidRequestContent,
+			Message: "client context must be base64 encoded",
+		}
+	}
+
+	var object map[string]any
+	if err := json.Unmarshal(decoded, &object); err != nil || object == nil {
+		return "", &RequestError{
+			Type:    ErrorTypeInvalidRequestContent,
+			Message: "client context must be a JSON object",
+		}
+	}
+
+	return string(decoded), nil
+}
@@ -0,0 +1,61 @@
+package invocation
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	XAmzFunctionError = "X-Amz-Function-Error"
+
+	FunctionErrorUnhandled = "Unhandled"
+)
+
+// FunctionError is the error document returned by AWS when the function
+// failed.
+type FunctionError struct {
+	ErrorMessage string          `json:"errorMessage"`
+	ErrorType    string          `json:"errorType"`
+	StackTrace   json.RawMessage `json:"stackTrace,omitempty"`
+}
+
+func (e *FunctionError) Error() string {
+	return e.ErrorType + ": " + e.ErrorMessage
+}
+
+// NewFunctionError normalizes the error posted by a runtime. Runtimes usually
+// post a JSON document, but any other body is accepted and used as the error
+// message.
+func NewFunctionError(errorType string, body []byte) *FunctionError {
+	var fnErr FunctionError
+	if err := json.Unmarshal(body, &fnErr); err != nil || (fnErr.ErrorMessage == "" && fnErr.ErrorType == "") {
+		fnErr = FunctionError{
+			ErrorMessage: string(body),
+		}
+	}
+
+	if fnErr.ErrorType == "" {
+		fnErr.ErrorType = errorType
+	}
+
+	if fnErr.ErrorType == "" {
+		fnErr.ErrorType = FunctionErrorUnhandled
+	}
+
+	return &fnErr
+}
+
+// ResponseFunctionError creates a response the way AWS reports a failed
+// function: HTTP 200 with the X-Amz-Function-Error header and the error
+// document as body.
+func ResponseFunctionError(fnErr *FunctionError) Response {
+	resp := ResponseJSON(http.StatusOK, fnErr)
+	if resp.Error != nil {
+		return resp
+	}
+
+	resp.Header.Set(XAmzFunctionError, FunctionErrorUnhandled)
+	resp.Error = fnErr
+
+	return resp
+}
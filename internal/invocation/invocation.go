@@ -2,6 +2,7 @@ package invocation
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,10 +16,47 @@ type Request struct {
 }
 
 type Response struct {
-	StatusCode int         `json:"statusCode"`
-	Header     http.Header `json:"header"`
-	Body       []byte      `json:"body"`
-	Error      error       `json:"-"`
+	StatusCode int           `json:"statusCode"`
+	Header     http.Header   `json:"header"`
+	Body       []byte        `json:"body"`
+	Stream     io.ReadCloser `json:"-"`
+	Error      error         `json:"-"`
+}
+
+// StreamError is returned by the stream of a response when the function
+// failed after it started to stream its response.
+type StreamError struct {
+	Type string
+	Body []byte
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Type, e.Body)
+}
+
+// Buffered reads a streamed response fully, so it can be sent to clients not
+// supporting response streaming.
+func (r Response) Buffered() Response {
+	if r.Stream == nil {
+		return r
+	}
+
+	defer r.Stream.Close()
+	body, err := io.ReadAll(r.Stream)
+	if err != nil {
+		var streamErr *StreamError
+		if errors.As(err, &streamErr) {
+			return ResponseFunctionError(NewFunctionError(streamErr.Type, streamErr.Body))
+		}
+
+		resp := ResponseMessage(http.StatusInternalServerError, "could not read lambda invocation response stream")
+		resp.Error = err
+		return resp
+	}
+
+	r.Body = body
+	r.Stream = nil
+	return r
 }
 
 const (
@@ -30,8 +68,10 @@ const (
 )
 
 type Invocation struct {
-	ID      uuid.UUID
-	Request `json:"request"`
+	ID            uuid.UUID
+	TraceID       string `json:"traceId"`
+	ClientContext string `json:"clientContext"`
+	Request       `json:"request"`
 
 	ResponseCh chan Response `json:"-"`
 }
@@ -46,6 +86,16 @@ func FromHTTPRequest(r *http.Request, maxBodySize int64) (Invocation, error) {
 
 	invocation.ID = id
 
+	invocation.TraceID, err = TraceHeader(r.Header.Get(XAmznTraceId))
+	if err != nil {
+		return invocation, err
+	}
+
+	invocation.ClientContext, err = ClientContext(r.Header.Get(XAmzClientContext))
+	if err != nil {
+		return invocation, err
+	}
+
 	defer r.Body.Close()
 	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
 	if err != nil {
@@ -0,0 +1,81 @@
+package invocation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	XAmznTraceId = "X-Amzn-Trace-Id"
+
+	traceRoot    = "Root"
+	traceParent  = "Parent"
+	traceSampled = "Sampled"
+)
+
+var traceRootPattern = regexp.MustCompile(`^1-[0-9a-f]{8}-[0-9a-f]{24}$`)
+
+// TraceHeader completes an incoming X-Ray trace header, generating the root
+// and parent segment ids when they are missing or invalid, the same way the
+// Lambda service does before passing the trace to the runtime.
+func TraceHeader(incoming string) (string, error) {
+	var root, parent, sampled string
+	var rest []string
+
+	for field := range strings.SplitSeq(incoming, ";") {
+		field = strings.TrimSpace(field)
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "":
+		case traceRoot:
+			root = value
+		case traceParent:
+			parent = value
+		case traceSampled:
+			sampled = value
+		default:
+			rest = append(rest, field)
+		}
+	}
+
+	if !traceRootPattern.MatchString(root) {
+		id, err := randomHex(12)
+		if err != nil {
+			return "", err
+		}
+		root = fmt.Sprintf("1-%08x-%s", time.Now().Unix(), id)
+	}
+
+	if parent == "" {
+		id, err := randomHex(8)
+		if err != nil {
+			return "", err
+		}
+		parent = id
+	}
+
+	if sampled == "" {
+		sampled = "0"
+	}
+
+	fields := append([]string{
+		traceRoot + "=" + root,
+		traceParent + "=" + parent,
+		traceSampled + "=" + sampled,
+	}, rest...)
+
+	return strings.Join(fields, ";"), nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
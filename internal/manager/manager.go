@@ -2,8 +2,12 @@ package manager
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -11,10 +15,13 @@ import (
 	"github.com/kbertalan/crie/internal/invocation"
 	"github.com/kbertalan/crie/internal/process"
 	"github.com/kbertalan/crie/internal/rapi"
+	"github.com/kbertalan/crie/internal/telemetry"
+	"github.com/kbertalan/crie/internal/watcher"
 )
 
 type ProcessConfig struct {
 	ID    string
+	Index int
 	Start bool
 }
 
@@ -22,6 +29,9 @@ type mgr struct {
 	cfg       config.Config
 	ch        <-chan invocation.Invocation
 	processes []*managedProcess
+
+	// reloadMu keeps the processes from being stopped during a reload.
+	reloadMu sync.Mutex
 }
 
 func Processes(ctx context.Context, cfg config.Config, processCfgs []ProcessConfig, invocationCh <-chan invocation.Invocation, wg *sync.WaitGroup) {
@@ -30,12 +40,24 @@ func Processes(ctx context.Context, cfg config.Config, processCfgs []ProcessConf
 	processes := make([]*managedProcess, 0, len(processCfgs))
 	for i, processCfg := range processCfgs {
 		address := cfg.ServerAddress.ProcessAddress(i)
+		cfg := processCfg.expand(cfg, address)
+		hub := telemetry.NewHub(processCfg.ID)
+		sandbox := process.NewSandbox(processCfg.ID, cfg, address)
 		p := managedProcess{
-			id:   processCfg.ID,
-			rapi: rapi.NewServer(processCfg.ID, cfg, address),
-			proc: process.NewProcess(processCfg.ID, cfg, address),
+			id:         processCfg.ID,
+			cfg:        cfg,
+			rapi:       rapi.NewServer(processCfg.ID, cfg, address, hub, sandbox.MaxMemoryUsed),
+			telemetry:  hub,
+			sandbox:    sandbox,
+			proc:       process.NewProcess(processCfg.ID, cfg, sandbox, logsOf(hub, telemetry.TypeFunction)),
+			extensions: process.Extensions(processCfg.ID, cfg, sandbox, logsOf(hub, telemetry.TypeExtension)),
 		}
 		p.cond = sync.NewCond(&p.mu)
+		p.proc.OnExit(p.exited)
+		for _, ext := range p.extensions {
+			ext.OnExit(p.extensionExited)
+		}
+		p.sandbox.OnStorageExceeded(p.storageExceeded)
 
 		if processCfg.Start {
 			p.Start()
@@ -50,9 +72,22 @@ func Processes(ctx context.Context, cfg config.Config, processCfgs []ProcessConf
 		processes: processes,
 	}
 
+	if len(cfg.WatchPaths) > 0 {
+		log.Printf("watching %v for changes", cfg.WatchPaths)
+		go watcher.Watch(ctx, cfg.WatchPaths, cfg.WatchInterval, func() {
+			m.reload(ctx)
+		})
+	}
+
 	m.run(ctx)
 }
 
+func logsOf(hub *telemetry.Hub, eventType string) func() io.Writer {
+	return func() io.Writer {
+		return hub.Writer(eventType)
+	}
+}
+
 func (m *mgr) run(ctx context.Context) {
 	defer m.Close()
 	for {
@@ -74,6 +109,12 @@ func (m *mgr) handle(ctx context.Context, inv invocation.Invocation) {
 		if attempt > 0 {
 			time.Sleep(m.cfg.DelayBetweenHandleAttempts)
 		}
+
+		if state, failed := m.failed(); failed {
+			inv.ResponseCh <- invocation.ResponseFunctionError(exitError(state))
+			close(inv.ResponseCh)
+			return
+		}
 		for _, p := range m.processes {
 			select {
 			case <-ctx.Done():
@@ -92,7 +133,40 @@ func (m *mgr) handle(ctx context.Context, inv invocation.Invocation) {
 	close(inv.ResponseCh)
 }
 
+// failed tells whether every process gave up restarting the runtime, and
+// returns how the runtime exited last time.
+func (m *mgr) failed() (*os.ProcessState, bool) {
+	var state *os.ProcessState
+	for _, p := range m.processes {
+		lastExit, failed := p.proc.Failed()
+		if !failed {
+			return nil, false
+		}
+		state = lastExit
+	}
+
+	return state, len(m.processes) > 0
+}
+
+// reload restarts the execution environments one by one, so the others keep
+// handling invocations meanwhile.
+func (m *mgr) reload(ctx context.Context) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	log.Printf("watched files changed, restarting Lambda processes")
+	for _, p := range m.processes {
+		if ctx.Err() != nil {
+			return
+		}
+		p.reload()
+	}
+}
+
 func (m *mgr) Close() {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
 	for _, p := range m.processes {
 		p.Stop()
 	}
@@ -102,10 +176,27 @@ type managedProcess struct {
 	mu   sync.Mutex
 	cond *sync.Cond
 	id   string
+	cfg  config.Config
 	rapi *rapi.Server
 	proc *process.Process
 
+	telemetry  *telemetry.Hub
+	sandbox    *process.Sandbox
+	extensions []*process.Process
+
 	status managedProcessStatus
+
+	// extensionCrashed is set when an extension exits on its own, guarded by
+	// mu. The execution environment is recycled before the next invocation.
+	// Extensions exit on their own on shutdown as well, which is expected.
+	extensionCrashed bool
+	shuttingDown     bool
+	retiring         bool
+
+	startedAt   time.Time
+	invocations uint32
+	frozenAt    time.Time
+	lifetime    *time.Timer
 }
 
 type managedProcessStatus int
@@ -113,45 +204,387 @@ type managedProcessStatus int
 const (
 	idle managedProcessStatus = iota
 	processing
+	reloading
 )
 
 func (p *managedProcess) Start() {
+	if p.startedAt.IsZero() {
+		p.startedAt = time.Now()
+		p.armLifetime()
+	}
 	p.rapi.Start()
+	for _, ext := range p.extensions {
+		ext.Start()
+	}
 	p.proc.Start()
 }
 
 func (p *managedProcess) Stop() {
-	p.waitForIdle()
+	p.mu.Lock()
+	for p.status != idle {
+		p.cond.Wait()
+	}
+	p.shuttingDown = true
+	p.mu.Unlock()
+
+	if p.lifetime != nil {
+		p.lifetime.Stop()
+	}
+
+	p.thaw()
+	p.shutdownExtensions()
 	p.proc.Stop()
+	for _, ext := range p.extensions {
+		ext.Stop()
+	}
 	p.rapi.Stop()
+	p.sandbox.Release()
+	p.reportViolations()
 }
 
-func (p *managedProcess) waitForIdle() {
+// exited fails the invocation in progress right away when the runtime exits,
+// instead of letting it wait for its deadline. The execution environment is
+// recycled afterwards by handle.
+func (p *managedProcess) exited(exit process.Exit) {
+	if exit.OutOfMemory {
+		log.Printf("[%s] runtime ran out of memory: %s", p.id, exit.State)
+		p.rapi.Fail(&invocation.FunctionError{
+			ErrorMessage: fmt.Sprintf("Runtime exited with error: %s", exit.State),
+			ErrorType:    rapi.ErrorTypeOutOfMemory,
+		})
+		return
+	}
+
+	p.rapi.Fail(exitError(exit.State))
+}
+
+// storageExceeded fails the invocation in progress when the processes write
+// more into the temporary directory than the ephemeral storage size. The
+// execution environment is recycled afterwards by handle, wiping the directory.
+// An idle environment, written by background work of the function, is
+// recycled right away.
+func (p *managedProcess) storageExceeded(used uint64) {
+	p.mu.Lock()
+	claimed := p.status == idle && !p.shuttingDown
+	if claimed {
+		p.status = reloading
+	}
+	p.mu.Unlock()
+
+	if claimed {
+		defer p.setIdle()
+		log.Printf("[%s] ephemeral storage exceeded while idle, recycling execution environment", p.id)
+		p.thaw()
+		p.recycle()
+		return
+	}
+
+	p.rapi.Fail(&invocation.FunctionError{
+		ErrorMessage: fmt.Sprintf("Ephemeral storage exceeded: %d MB used of %d MB", (used+1024*1024-1)/(1024*1024), p.cfg.EphemeralStorageSize),
+		ErrorType:    rapi.ErrorTypeStorageExceeded,
+	})
+}
+
+// extensionExited fails the execution environment when an extension exits on
+// its own, like Lambda does, as its registration would stay with the Runtime
+// API and keep receiving events.
+func (p *managedProcess) extensionExited(exit process.Exit) {
+	p.mu.Lock()
+	if p.shuttingDown || p.retiring {
+		p.mu.Unlock()
+		return
+	}
+	p.extensionCrashed = true
+	p.mu.Unlock()
+
+	log.Printf("[%s] extension exited with %s", p.id, exit.State)
+
+	p.rapi.Fail(&invocation.FunctionError{
+		ErrorMessage: fmt.Sprintf("Extension exited with error: %s", exit.State),
+		ErrorType:    rapi.ErrorTypeExtensionCrash,
+	})
+}
+
+func exitError(state *os.ProcessState) *invocation.FunctionError {
+	return &invocation.FunctionError{
+		ErrorMessage: fmt.Sprintf("Runtime exited with error: %s", state),
+		ErrorType:    rapi.ErrorTypeExitError,
+	}
+}
+
+func (p *managedProcess) reportViolations() {
+	violations := p.rapi.Violations()
+	if len(violations) == 0 {
+		return
+	}
+
+	log.Printf("[%s] runtime committed %d protocol violations:", p.id, len(violations))
+	for _, violation := range violations {
+		log.Printf("[%s]   %s", p.id, violation)
+	}
+}
+
+func (p *managedProcess) handle(ctx context.Context, inv invocation.Invocation) {
+	p.thaw()
+	p.retireIfExpired()
+	p.recycleIfExtensionCrashed()
+	p.Start()
+	if p.cfg.Debug && p.cfg.DebugWaitForDebugger {
+		if err := p.proc.WaitForDebugger(ctx); err != nil {
+			inv.ResponseCh <- invocation.ResponseMessage(http.StatusInternalServerError, "server shutdown")
+			close(inv.ResponseCh)
+			return
+		}
+	}
+	err := p.rapi.Next(inv)
+	if err == nil {
+		p.proc.Succeeded()
+		p.invocations++
+		if p.cfg.MaxInvocationsPerEnv > 0 && p.invocations >= p.cfg.MaxInvocationsPerEnv {
+			log.Printf("[%s] execution environment handled %d invocations, retiring", p.id, p.invocations)
+			p.retire()
+			return
+		}
+	}
+
+	var initErr *rapi.InitError
+	if errors.As(err, &initErr) {
+		log.Printf("[%s] %+v, retrying with suppressed init for [%s]", p.id, initErr, inv.ID)
+		p.recycle()
+		p.Start()
+		err = p.rapi.Next(inv)
+	}
+
+	if errors.As(err, &initErr) {
+		inv.ResponseCh <- invocation.ResponseFunctionError(initErr.Err)
+		close(inv.ResponseCh)
+	}
+
+	if err != nil {
+		log.Printf("[%s] invocation [%s] failed, recycling execution environment: %+v", p.id, inv.ID, err)
+		p.recycle()
+		return
+	}
+
+	p.freeze(ctx)
+}
+
+// freeze suspends the execution environment between invocations, so timers
+// and background work of the function stall like in Lambda. It waits for the
+// runtime and the extensions to finish the invocation first, and holds the
+// telemetry of the extensions until the environment is thawed.
+func (p *managedProcess) freeze(ctx context.Context) {
+	if !p.cfg.FreezeIdle || !p.frozenAt.IsZero() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.LambdaRuntimeDeadline)
+	defer cancel()
+	if err := p.rapi.WaitParked(ctx); err != nil {
+		log.Printf("[%s] execution environment is still busy, not freezing it: %+v", p.id, err)
+		return
+	}
+
+	p.telemetry.Hold()
+	p.proc.Freeze()
+	for _, ext := range p.extensions {
+		ext.Freeze()
+	}
+	p.frozenAt = time.Now()
+}
+
+// thaw resumes the execution environment frozen after the previous
+// invocation.
+func (p *managedProcess) thaw() {
+	if p.frozenAt.IsZero() {
+		return
+	}
+
+	for _, ext := range p.extensions {
+		ext.Thaw()
+	}
+	p.proc.Thaw()
+	p.telemetry.Release()
+	log.Printf("[%s] execution environment thawed after being frozen for %s", p.id, time.Since(p.frozenAt).Round(time.Millisecond))
+	p.frozenAt = time.Time{}
+}
+
+// retireIfExpired retires the execution environment when it is older than
+// the configured lifetime, so the invocation about to be handled starts it
+// from scratch.
+func (p *managedProcess) retireIfExpired() {
+	if p.cfg.MaxEnvLifetime <= 0 || p.startedAt.IsZero() {
+		return
+	}
+
+	if age := time.Since(p.startedAt); age >= p.cfg.MaxEnvLifetime {
+		log.Printf("[%s] execution environment is running for %s, retiring", p.id, age.Round(time.Millisecond))
+		p.retire()
+	}
+}
+
+// armLifetime starts the timer retiring the execution environment at the end
+// of its lifetime, even when no invocation arrives to retire it.
+func (p *managedProcess) armLifetime() {
+	if p.cfg.MaxEnvLifetime <= 0 {
+		return
+	}
+
+	if p.lifetime != nil {
+		p.lifetime.Stop()
+	}
+
+	startedAt := p.startedAt
+	p.lifetime = time.AfterFunc(p.cfg.MaxEnvLifetime, func() {
+		if !p.waitForIdleAs(reloading) {
+			return
+		}
+		defer p.setIdle()
+
+		if p.startedAt.Equal(startedAt) {
+			p.retireIfExpired()
+		}
+	})
+}
+
+// recycleIfExtensionCrashed recycles the execution environment when one of
+// its extensions exited since the previous invocation.
+func (p *managedProcess) recycleIfExtensionCrashed() {
+	p.mu.Lock()
+	crashed := p.extensionCrashed
+	p.mu.Unlock()
+
+	if crashed {
+		log.Printf("[%s] an extension exited, recycling execution environment", p.id)
+		p.recycle()
+	}
+}
+
+// retire shuts the execution environment down the way Lambda does when it is
+// not needed anymore: the extensions receive a SHUTDOWN event, then the
+// processes receive SIGTERM. The next invocation starts it from scratch.
+func (p *managedProcess) retire() {
+	p.mu.Lock()
+	p.retiring = true
+	p.mu.Unlock()
+
+	started := !p.startedAt.IsZero()
+	p.startedAt = time.Time{}
+	p.invocations = 0
+	p.thaw()
+	if started {
+		p.shutdownExtensions()
+	}
+	p.proc.Terminate()
+	for _, ext := range p.extensions {
+		ext.Terminate()
+	}
+	p.rapi.Stop()
+	p.sandbox.Reset()
+
+	p.mu.Lock()
+	p.retiring = false
+	p.extensionCrashed = false
+	p.mu.Unlock()
+}
+
+// recycle tears down the execution environment immediately, so the next
+// invocation starts it from scratch. It is used when the environment is
+// broken, like after a crash or a timeout; retire is used otherwise.
+func (p *managedProcess) recycle() {
+	p.startedAt = time.Time{}
+	p.invocations = 0
+	p.proc.Kill()
+	for _, ext := range p.extensions {
+		ext.Kill()
+	}
+	p.rapi.Stop()
+	p.sandbox.Reset()
+
+	p.mu.Lock()
+	p.extensionCrashed = false
+	p.mu.Unlock()
+}
+
+func (p *managedProcess) shutdownExtensions() {
+	acknowledgedCh := p.rapi.Shutdown()
+
+	exitedCh := make(chan struct{})
+	go func() {
+		defer close(exitedCh)
+		for _, ext := range p.extensions {
+			ext.Wait()
+		}
+	}()
+
+	select {
+	case <-acknowledgedCh:
+	case <-exitedCh:
+	case <-time.After(p.cfg.ExtensionShutdownTimeout):
+		log.Printf("[%s] extensions did not finish shutdown in %s", p.id, p.cfg.ExtensionShutdownTimeout)
+	}
+}
+
+// reload retires the execution environment once the invocation in progress
+// is completed. An environment which was started is started again, so it is
+// initialized with the changed files before the next invocation.
+func (p *managedProcess) reload() {
+	if !p.waitForIdleAs(reloading) {
+		return
+	}
+	defer p.setIdle()
+
+	started := !p.startedAt.IsZero()
+	p.retire()
+	p.proc.Reset()
+	if started {
+		p.Start()
+	}
+	log.Printf("[%s] execution environment reloaded", p.id)
+}
+
+// waitForIdleAs waits until the execution environment is idle and takes it
+// over with the status under the same lock, so no invocation is handed to it
+// meanwhile. It returns false when the environment is shut down.
+func (p *managedProcess) waitForIdleAs(status managedProcessStatus) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for p.status != idle {
 		p.cond.Wait()
 	}
+
+	if p.shuttingDown {
+		return false
+	}
+
+	p.status = status
+	return true
+}
+
+func (p *managedProcess) setIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = idle
+	p.cond.Broadcast()
 }
 
 func (p *managedProcess) TryHandle(ctx context.Context, inv invocation.Invocation) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.status == processing {
+	if p.status != idle {
+		return false
+	}
+
+	if _, failed := p.proc.Failed(); failed {
 		return false
 	}
 
 	p.status = processing
 
 	go func() {
-		p.Start()
-		p.rapi.Next(inv)
-
-		p.mu.Lock()
-		defer p.mu.Unlock()
-		p.status = idle
-		p.cond.Signal()
+		defer p.setIdle()
+		p.handle(ctx, inv)
 	}()
 	return true
 }
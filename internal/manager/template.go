@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// expand replaces the placeholders in the command and in the CRIE_ENV_*
+// variables with the values of the process, so concurrent runtimes can be
+// given their own debugger port, like --inspect=0.0.0.0:922{index}.
+func (c ProcessConfig) expand(cfg config.Config, address config.ListenAddress) config.Config {
+	replacer := strings.NewReplacer(
+		"{index}", strconv.Itoa(c.Index),
+		"{id}", c.ID,
+		"{rapiPort}", address.Port(),
+	)
+
+	cfg.CommandName = replacer.Replace(cfg.CommandName)
+
+	args := make([]string, len(cfg.CommandArgs))
+	for i, arg := range cfg.CommandArgs {
+		args[i] = replacer.Replace(arg)
+	}
+	cfg.CommandArgs = args
+
+	env := make([]string, len(cfg.ExtraEnvironment))
+	for i, variable := range cfg.ExtraEnvironment {
+		name, value, _ := strings.Cut(variable, "=")
+		env[i] = name + "=" + replacer.Replace(value)
+	}
+	cfg.ExtraEnvironment = env
+
+	return cfg
+}
@@ -0,0 +1,114 @@
+package process
+
+import (
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// recordExit counts an exit of a process which is restarted, and returns how
+// long to wait before restarting it. The delay grows exponentially with the
+// consecutive failures, with jitter, and the process is marked failed once
+// there are too many of them. The caller must hold p.mu.
+func (p *Process) recordExit(state *os.ProcessState) time.Duration {
+	p.lastExit = state
+	p.failures++
+
+	if p.cfg.ProcessMaxFailures > 0 && p.failures >= p.cfg.ProcessMaxFailures {
+		p.state = failed
+		log.Printf("[%s] process failed %d times in a row, last with %s, not restarting it anymore", p.id, p.failures, state)
+		return 0
+	}
+
+	delay := p.cfg.ProcessRestartDelay << min(p.failures-1, 30)
+	if delay <= 0 || delay > p.cfg.ProcessMaxRestartDelay {
+		delay = p.cfg.ProcessMaxRestartDelay
+	}
+
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	log.Printf("[%s] process exited with %s, restarting in %s (restarts: %d, consecutive failures: %d)", p.id, state, delay, p.restarts, p.failures)
+	p.restartAt = time.Now().Add(delay)
+	return delay
+}
+
+// restartAfter starts the process again after the delay, unless it is killed,
+// stopped or started again in the meantime. The exited command identifies the
+// run being restarted.
+func (p *Process) restartAfter(exited *exec.Cmd, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state != running || p.cmd != exited {
+		return
+	}
+
+	p.restartTimer = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.state != running || p.cmd != exited {
+			return
+		}
+
+		p.restartTimer = nil
+		p.restarts++
+		p.start()
+	})
+}
+
+// waitRestartDelay blocks until the backoff delay after the last crash passes,
+// unless the restart is left to the pending timer.
+func (p *Process) waitRestartDelay() {
+	p.mu.Lock()
+	delay := time.Until(p.restartAt)
+	pending := p.restartTimer != nil
+	p.mu.Unlock()
+
+	if delay > 0 && !pending {
+		log.Printf("[%s] waiting %s before starting the process after its crash", p.id, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// cancelRestart stops a pending restart. The caller must hold p.mu.
+func (p *Process) cancelRestart() {
+	if p.restartTimer != nil {
+		p.restartTimer.Stop()
+		p.restartTimer = nil
+	}
+}
+
+// Failed tells whether the process is not restarted anymore because of its
+// consecutive failures, and returns how it exited last time.
+func (p *Process) Failed() (*os.ProcessState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastExit, p.state == failed
+}
+
+// Succeeded resets the consecutive failures after the process did its job.
+func (p *Process) Succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures = 0
+}
+
+// Reset gives a process which gave up restarting another chance, like after
+// its command was rebuilt.
+func (p *Process) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state == failed {
+		p.state = idle
+	}
+	p.failures = 0
+	p.restartAt = time.Time{}
+}
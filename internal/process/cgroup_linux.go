@@ -0,0 +1,211 @@
+package process
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	procSelfCgroup    = "/proc/self/cgroup"
+	procSelfMountinfo = "/proc/self/mountinfo"
+
+	// crieCgroup is the leaf crie moves itself into, as cgroup v2 does not
+	// allow enabling controllers for the children of a cgroup which has
+	// processes of its own.
+	crieCgroup = "crie"
+)
+
+// cgroup is a cgroup v2 leaf holding the processes of one sandbox.
+type cgroup struct {
+	path string
+}
+
+// newCgroup creates a leaf next to the cgroup of crie and writes the given
+// interface files into it. The controllers of the files are enabled in the
+// parent cgroup.
+func newCgroup(id string, files map[string]string) (*cgroup, error) {
+	parent, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	var controllers []string
+	for file := range files {
+		controller, _, _ := strings.Cut(file, ".")
+		controllers = append(controllers, controller)
+	}
+
+	if err := enableControllers(parent, controllers); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(parent, fmt.Sprintf("crie-%d-%s", os.Getpid(), strings.ReplaceAll(id, "/", "-")))
+	if err := os.Mkdir(path, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+
+	cg := &cgroup{path: path}
+	for file, value := range files {
+		err := cg.write(file, value)
+		if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(file, ".swap.max") {
+			continue
+		}
+		if err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	return cg, nil
+}
+
+// attach makes the command start inside the cgroup.
+func (c *cgroup) attach(cmd *exec.Cmd) (func(), error) {
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return func() {
+		dir.Close()
+	}, nil
+}
+
+// oomKills returns how many processes of the cgroup were killed by the out of
+// memory killer.
+func (c *cgroup) oomKills() int {
+	events, err := os.ReadFile(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return 0
+	}
+
+	for line := range strings.Lines(string(events)) {
+		if value, found := strings.CutPrefix(strings.TrimSpace(line), "oom_kill "); found {
+			count, _ := strconv.Atoi(value)
+			return count
+		}
+	}
+
+	return 0
+}
+
+func (c *cgroup) peakMemory() (uint64, bool) {
+	peak, err := os.ReadFile(filepath.Join(c.path, "memory.peak"))
+	if err != nil {
+		return 0, false
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(peak)), 10, 64)
+	return value, err == nil
+}
+
+func (c *cgroup) write(file string, value string) error {
+	return os.WriteFile(filepath.Join(c.path, file), []byte(value), 0o644)
+}
+
+func (c *cgroup) remove() {
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("cannot remove cgroup %s: %+v", c.path, err)
+	}
+}
+
+// enableControllers makes the controllers available for the children of the
+// parent cgroup, moving crie into a leaf of its own when necessary.
+func enableControllers(parent string, controllers []string) error {
+	available, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	var enable []string
+	for _, controller := range controllers {
+		if !strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+controller+" ") {
+			return fmt.Errorf("%s controller is not available in %s", controller, parent)
+		}
+		enable = append(enable, "+"+controller)
+	}
+
+	subtreeControl := filepath.Join(parent, "cgroup.subtree_control")
+	err = os.WriteFile(subtreeControl, []byte(strings.Join(enable, " ")), 0o644)
+	if !errors.Is(err, syscall.EBUSY) {
+		return err
+	}
+
+	leaf := filepath.Join(parent, crieCgroup)
+	if err := os.Mkdir(leaf, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(subtreeControl, []byte(strings.Join(enable, " ")), 0o644)
+}
+
+// ownCgroup returns the directory of the cgroup v2 crie is running in, or the
+// parent of it when crie already moved itself into its own leaf.
+func ownCgroup() (string, error) {
+	mountpoint, err := cgroup2Mountpoint()
+	if err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+
+	for line := range strings.Lines(string(content)) {
+		if path, found := strings.CutPrefix(strings.TrimSpace(line), "0::"); found {
+			if filepath.Base(path) == crieCgroup {
+				path = filepath.Dir(path)
+			}
+			return filepath.Join(mountpoint, path), nil
+		}
+	}
+
+	return "", errors.New("crie is not running in a cgroup v2 hierarchy")
+}
+
+func cgroup2Mountpoint() (string, error) {
+	file, err := os.Open(procSelfMountinfo)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", errors.New("cgroup v2 is not mounted")
+}
+
+func formatUint(value uint64) string {
+	return strconv.FormatUint(value, 10)
+}
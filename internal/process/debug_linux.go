@@ -0,0 +1,69 @@
+package process
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// traced tells whether a process of the process group is traced by a
+// debugger, as reported by the TracerPid field of /proc/<pid>/status.
+func traced(pgid int) bool {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || processGroup(pid) != pgid {
+			continue
+		}
+
+		if tracerPid(pid) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processGroup returns the process group of a process from the fifth field of
+// /proc/<pid>/stat. The command name in the second field may contain spaces,
+// so the fields are counted from its closing parenthesis.
+func processGroup(pid int) int {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return 0
+	}
+
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 3 {
+		return 0
+	}
+
+	pgid, _ := strconv.Atoi(fields[2])
+	return pgid
+}
+
+func tracerPid(pid int) int {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+
+	for line := range strings.Lines(string(status)) {
+		if value, found := strings.CutPrefix(line, "TracerPid:"); found {
+			tracer, _ := strconv.Atoi(strings.TrimSpace(value))
+			return tracer
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,73 @@
+package process
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbertalan/crie/internal/config"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	crieVariablePrefix = "CRIE_"
+	functionVersion    = "$LATEST"
+)
+
+// Environment returns the environment of the processes of one execution
+// environment: the original environment without the CRIE_* variables, the
+// variables given with CRIE_ENV_*, and the variables Lambda defines for
+// functions. The placeholders in the values of the CRIE_ENV_* variables are
+// expected to be expanded for the process already, see ProcessConfig in the
+// manager. Each call creates a new log stream name, so every managed process
+// logs into its own stream.
+func Environment(cfg config.Config, rapi config.ListenAddress) []string {
+	lambda := map[string]string{
+		"AWS_LAMBDA_RUNTIME_API":          rapi.AwsLambdaRuntimeAPI(),
+		"AWS_LAMBDA_FUNCTION_NAME":        cfg.LambdaName,
+		"AWS_LAMBDA_FUNCTION_MEMORY_SIZE": fmt.Sprint(cfg.LambdaMemorySize),
+		"AWS_LAMBDA_FUNCTION_VERSION":     functionVersion,
+		"AWS_LAMBDA_LOG_GROUP_NAME":       "/aws/lambda/" + cfg.LambdaName,
+		"AWS_LAMBDA_LOG_STREAM_NAME":      logStreamName(),
+		"AWS_LAMBDA_INITIALIZATION_TYPE":  telemetry.InitializationTypeOnDemand,
+		"AWS_REGION":                      cfg.LambdaRegion,
+		"AWS_DEFAULT_REGION":              cfg.LambdaRegion,
+		"LAMBDA_TASK_ROOT":                cfg.LambdaTaskRoot,
+		"_HANDLER":                        cfg.LambdaHandler,
+	}
+
+	env := make([]string, 0, len(cfg.OriginalEnvironment)+len(cfg.ExtraEnvironment)+len(lambda))
+	for _, variable := range slices.Concat(functionEnvironment(cfg.OriginalEnvironment), cfg.ExtraEnvironment) {
+		name, _, _ := strings.Cut(variable, "=")
+		if _, reserved := lambda[name]; !reserved {
+			env = append(env, variable)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(lambda)) {
+		env = append(env, name+"="+lambda[name])
+	}
+
+	return env
+}
+
+// functionEnvironment removes the configuration of crie from the environment
+// passed to the function.
+func functionEnvironment(environment []string) []string {
+	env := make([]string, 0, len(environment))
+	for _, variable := range environment {
+		if !strings.HasPrefix(variable, crieVariablePrefix) {
+			env = append(env, variable)
+		}
+	}
+
+	return env
+}
+
+func logStreamName() string {
+	id := uuid.New()
+	return fmt.Sprintf("%s/[%s]%x", time.Now().UTC().Format("2006/01/02"), functionVersion, id[:])
+}
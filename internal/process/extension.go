@@ -0,0 +1,61 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// Extensions creates a process for every executable found in the configured
+// extensions directory, the same way Lambda starts external extensions from
+// /opt/extensions before the runtime is initialized.
+func Extensions(id string, cfg config.Config, sandbox *Sandbox, logs func() io.Writer) []*Process {
+	entries, err := os.ReadDir(cfg.ExtensionsDir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[%s] cannot read extensions directory %s: %+v", id, cfg.ExtensionsDir, err)
+		}
+		return nil
+	}
+
+	var extensions []*Process
+	for _, entry := range entries {
+		path := filepath.Join(cfg.ExtensionsDir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("[%s] cannot stat extension %s: %+v", id, path, err)
+			continue
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+
+		extensions = append(extensions, NewExtension(id, cfg, sandbox, path, logs))
+	}
+
+	return extensions
+}
+
+// NewExtension creates a process for an external extension. Unlike the
+// runtime, an extension is not restarted when it exits on its own, as that is
+// the expected reaction to a SHUTDOWN event.
+func NewExtension(id string, cfg config.Config, sandbox *Sandbox, path string, logs func() io.Writer) *Process {
+	return &Process{
+		id:      fmt.Sprintf("%s/%s", id, filepath.Base(path)),
+		cfg:     cfg,
+		sandbox: sandbox,
+		name:    path,
+		args:    nil,
+
+		restart: false,
+		logs:    logs,
+		cmd:     nil,
+	}
+}
@@ -0,0 +1,131 @@
+package process
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+const (
+	cpuPeriodUs = 100000
+	// memoryPerVCPU is the memory size in MB at which Lambda gives a function
+	// a full vCPU.
+	memoryPerVCPU = 1769
+	minCPUQuotaUs = 1000
+)
+
+// limits restricts the memory and CPU of the processes of a sandbox. A cgroup
+// v2 leaf limits all processes together and reports when they are killed for
+// exceeding the memory. Without a writable cgroup hierarchy the processes run
+// without limits.
+type limits struct {
+	id         string
+	files      map[string]string
+	cgroup     *cgroup
+	oomKills   int
+	generation int
+}
+
+func newLimits(id string, cfg config.Config) *limits {
+	l := &limits{
+		id: id,
+	}
+
+	files := make(map[string]string)
+	if cfg.EnforceMemorySize {
+		files["memory.max"] = formatUint(uint64(cfg.LambdaMemorySize) * 1024 * 1024)
+		files["memory.swap.max"] = "0"
+	}
+
+	if cfg.ThrottleCPU {
+		files["cpu.max"] = fmt.Sprintf("%d %d", cpuQuota(cfg.LambdaMemorySize), cpuPeriodUs)
+	}
+
+	cg, err := newCgroup(id, files)
+	if err != nil {
+		if cfg.EnforceMemorySize {
+			log.Printf("[%s] cannot use cgroup v2 to limit memory, running without limit: %+v", id, err)
+		}
+		if cfg.ThrottleCPU {
+			log.Printf("[%s] cannot use cgroup v2 to throttle cpu, running without limit: %+v", id, err)
+		}
+		return l
+	}
+
+	l.files = files
+	l.cgroup = cg
+	l.oomKills = cg.oomKills()
+	if cfg.EnforceMemorySize {
+		log.Printf("[%s] memory is limited to %d MB by cgroup %s", id, cfg.LambdaMemorySize, cg.path)
+	}
+	if cfg.ThrottleCPU {
+		log.Printf("[%s] cpu is limited to %s by cgroup %s", id, files["cpu.max"], cg.path)
+	}
+
+	return l
+}
+
+// cpuQuota returns the CPU time in microseconds the processes get in every
+// period, in proportion to the memory size like in Lambda.
+func cpuQuota(memorySize uint32) uint64 {
+	return max(uint64(memorySize)*cpuPeriodUs/memoryPerVCPU, minCPUQuotaUs)
+}
+
+func (l *limits) apply(cmd *exec.Cmd) (func(), error) {
+	if l.cgroup != nil {
+		return l.cgroup.attach(cmd)
+	}
+
+	return func() {}, nil
+}
+
+func (l *limits) outOfMemory() bool {
+	if l.cgroup == nil {
+		return false
+	}
+
+	oomKills := l.cgroup.oomKills()
+	killed := oomKills > l.oomKills
+	l.oomKills = oomKills
+
+	return killed
+}
+
+// peakMemory returns the peak memory usage of the cgroup, which is available
+// since Linux 5.19.
+func (l *limits) peakMemory() (uint64, bool) {
+	if l.cgroup == nil {
+		return 0, false
+	}
+
+	return l.cgroup.peakMemory()
+}
+
+// renew replaces the cgroup with a new one once its processes are killed, as
+// the peak memory usage of a cgroup cannot be reset for all of its readers.
+func (l *limits) renew() {
+	if l.cgroup == nil {
+		return
+	}
+
+	l.cgroup.remove()
+	l.generation++
+
+	cg, err := newCgroup(fmt.Sprintf("%s-%d", l.id, l.generation), l.files)
+	if err != nil {
+		log.Printf("[%s] cannot create new cgroup, running without cgroup limits: %+v", l.id, err)
+		l.cgroup = nil
+		return
+	}
+
+	l.cgroup = cg
+	l.oomKills = cg.oomKills()
+}
+
+func (l *limits) release() {
+	if l.cgroup != nil {
+		l.cgroup.remove()
+	}
+}
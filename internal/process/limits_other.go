@@ -0,0 +1,34 @@
+//go:build !linux
+
+package process
+
+import (
+	"log"
+	"os/exec"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// limits is not supported outside of Linux, processes run without limits.
+type limits struct{}
+
+func newLimits(id string, cfg config.Config) *limits {
+	log.Printf("[%s] resource limits are only supported on Linux", id)
+	return nil
+}
+
+func (l *limits) apply(cmd *exec.Cmd) (func(), error) {
+	return func() {}, nil
+}
+
+func (l *limits) outOfMemory() bool {
+	return false
+}
+
+func (l *limits) peakMemory() (uint64, bool) {
+	return 0, false
+}
+
+func (l *limits) renew() {}
+
+func (l *limits) release() {}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package process
+
+// peakResidentSetSize is not available for running processes outside of
+// Linux.
+func peakResidentSetSize(pid int) uint64 {
+	return 0
+}
@@ -3,7 +3,7 @@ package process
 import (
 	"context"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -19,7 +19,7 @@ func Delegate(ctx context.Context, cfg config.Config, cancel context.CancelFunc)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.Env = cfg.OriginalEnvironment
+	cmd.Env = functionEnvironment(cfg.OriginalEnvironment)
 
 	go func() {
 		defer cancel()
@@ -49,45 +49,97 @@ func Delegate(ctx context.Context, cfg config.Config, cancel context.CancelFunc)
 type Process struct {
 	mu sync.Mutex
 
-	id   string
-	cfg  config.Config
-	rapi config.ListenAddress
+	id      string
+	cfg     config.Config
+	sandbox *Sandbox
+	name    string
+	args    []string
+
+	restart bool
+	logs    func() io.Writer
+	exited  func(Exit)
 
 	cmd    *exec.Cmd
 	state  processState
 	doneCh chan struct{}
+
+	restartTimer *time.Timer
+	restartAt    time.Time
+	restarts     int
+	failures     int
+	lastExit     *os.ProcessState
 }
 
+const (
+	debuggerPollInterval = 100 * time.Millisecond
+
+	// outputWaitDelay limits how long the output of an exited command is
+	// copied, as processes which left its process group may keep it open.
+	outputWaitDelay = time.Second
+)
+
 type processState int
 
 const (
 	idle processState = iota
 	stopped
 	running
+	failed
 )
 
-func NewProcess(id string, cfg config.Config, rapi config.ListenAddress) *Process {
+// Exit describes a process exiting on its own, without being stopped or
+// killed by crie.
+type Exit struct {
+	State       *os.ProcessState
+	OutOfMemory bool
+}
+
+func NewProcess(id string, cfg config.Config, sandbox *Sandbox, logs func() io.Writer) *Process {
 	return &Process{
-		id:   id,
-		cfg:  cfg,
-		rapi: rapi,
-		cmd:  nil,
+		id:      id,
+		cfg:     cfg,
+		sandbox: sandbox,
+		name:    cfg.CommandName,
+		args:    cfg.CommandArgs,
+
+		restart: true,
+		logs:    logs,
+		cmd:     nil,
 	}
 }
 
+// Start starts the command unless it is running already. After a crash it
+// waits for the backoff delay first, even when the restart pending after the
+// crash was cancelled by Kill.
 func (p *Process) Start() error {
+	p.waitRestartDelay()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	return p.start()
+}
+
+// start starts the command unless it is running already. The caller must hold
+// p.mu.
+func (p *Process) start() error {
 	if p.state == stopped {
 		return errors.New("already stopped")
 	}
 
+	if p.state == failed {
+		return errors.New("failed")
+	}
+
 	if p.state == running && p.cmd != nil && p.cmd.ProcessState == nil {
 		return nil
 	}
 
-	p.cmd = exec.Command(p.cfg.CommandName, p.cfg.CommandArgs...)
+	if p.restartTimer != nil {
+		return nil
+	}
+
+	p.cmd = exec.Command(p.name, p.args...)
 	devNull, err := os.Open(os.DevNull)
 	if err != nil {
 		log.Printf("[%s] cannot open devnull: %+v", p.id, err)
@@ -95,13 +147,20 @@ func (p *Process) Start() error {
 	}
 	defer devNull.Close()
 	p.cmd.Stdin = devNull
-	p.cmd.Stdout = os.Stdout
-	p.cmd.Stderr = os.Stderr
+	p.cmd.Stdout = p.output(os.Stdout)
+	p.cmd.Stderr = p.output(os.Stderr)
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	p.cmd.WaitDelay = outputWaitDelay
 
-	p.cmd.Env = append(p.cmd.Env, p.cfg.OriginalEnvironment...)
-	p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("AWS_LAMBDA_RUNTIME_API=%s", p.rapi.AwsLambdaRuntimeAPI()))
+	started, err := p.sandbox.prepare(p.cmd)
+	if err != nil {
+		log.Printf("[%s] cannot prepare process: %+v", p.id, err)
+		return err
+	}
 
-	if err := p.cmd.Start(); err != nil {
+	err = p.cmd.Start()
+	started()
+	if err != nil {
 		log.Printf("[%s] process start failed: %+v", p.id, err)
 		return err
 	}
@@ -110,36 +169,136 @@ func (p *Process) Start() error {
 	p.state = running
 	log.Printf("[%s] process started", p.id)
 
-	go func() {
-		p.cmd.Wait()
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		p.sandbox.exited(cmd)
 		close(p.doneCh)
 		log.Printf("[%s] process ended", p.id)
 
 		p.mu.Lock()
 		state := p.state
+		exited := p.exited
+		var delay time.Duration
+		if state == running && p.restart {
+			delay = p.recordExit(cmd.ProcessState)
+		}
+		gaveUp := p.state == failed
 		p.mu.Unlock()
-		if state == running {
-			p.Start()
+
+		if state == running && exited != nil {
+			exited(Exit{
+				State:       cmd.ProcessState,
+				OutOfMemory: p.sandbox.outOfMemory(),
+			})
 		}
-	}()
+
+		if state == running && p.restart && !gaveUp {
+			p.restartAfter(cmd, delay)
+		}
+	}(p.cmd)
 
 	return nil
 }
 
+// OnExit registers a function called when the process exits on its own, before
+// it is restarted.
+func (p *Process) OnExit(exited func(Exit)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.exited = exited
+}
+
+// output copies the output of the command into the configured logs as well,
+// so it can be forwarded to telemetry subscribers.
+func (p *Process) output(w io.Writer) io.Writer {
+	if p.logs == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, p.logs())
+}
+
+// Wait blocks until the currently started command exits.
+func (p *Process) Wait() {
+	p.mu.Lock()
+	doneCh := p.doneCh
+	p.mu.Unlock()
+
+	if doneCh != nil {
+		<-doneCh
+	}
+}
+
 func (p *Process) Stop() {
 	if !p.sendTermSignal() {
 		return
 	}
 
+	p.awaitTermination(p.doneCh)
+}
+
+// Terminate stops the command gracefully like Stop, but it does not prevent
+// the process from being started again, like Kill.
+func (p *Process) Terminate() {
+	p.mu.Lock()
+	if p.state != running {
+		p.mu.Unlock()
+		return
+	}
+
+	p.state = idle
+	p.cancelRestart()
+	doneCh := p.doneCh
+	alive := p.alive()
+	if alive {
+		if err := p.signal(syscall.SIGTERM); err != nil {
+			log.Printf("[%s] process signal failed: %+v", p.id, err)
+		}
+		p.signal(syscall.SIGCONT)
+	}
+	p.mu.Unlock()
+
+	if alive {
+		p.awaitTermination(doneCh)
+		log.Printf("[%s] process terminated", p.id)
+	}
+}
+
+// awaitTermination waits for the command to exit after SIGTERM, and kills it
+// when it does not exit in time.
+func (p *Process) awaitTermination(doneCh chan struct{}) {
 	select {
-	case <-p.doneCh:
+	case <-doneCh:
 	case <-time.After(p.cfg.ProcessShutdownTimeout):
 		log.Printf("[%s] process did not exit after SIGTERM, sending SIGKILL", p.id)
 		p.sendKillSignal()
-		<-p.doneCh
+		<-doneCh
 	}
 }
 
+// Kill terminates the command immediately and waits for it to exit. Unlike
+// Stop, it does not prevent the process from being started again. The backoff
+// delay of a crash still applies to the next Start.
+func (p *Process) Kill() {
+	p.mu.Lock()
+	if p.state != running {
+		p.mu.Unlock()
+		return
+	}
+
+	p.state = idle
+	p.cancelRestart()
+	doneCh := p.doneCh
+	if p.alive() {
+		p.signal(syscall.SIGKILL)
+	}
+	p.mu.Unlock()
+
+	<-doneCh
+	log.Printf("[%s] process killed", p.id)
+}
+
 func (p *Process) sendTermSignal() bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -149,24 +308,115 @@ func (p *Process) sendTermSignal() bool {
 	}
 
 	p.state = stopped
+	p.cancelRestart()
 
-	if p.cmd == nil || p.cmd.Process == nil || p.cmd.ProcessState != nil {
+	if !p.alive() {
 		return false
 	}
 
-	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if err := p.signal(syscall.SIGTERM); err != nil {
 		log.Printf("[%s] process signal failed: %+v", p.id, err)
 		return false
 	}
+	p.signal(syscall.SIGCONT)
 
 	return true
 }
 
+// WaitForDebugger blocks until a debugger traces a process of the command's
+// process group, or the command exits. It returns the error of the context
+// when it is done before.
+func (p *Process) WaitForDebugger(ctx context.Context) error {
+	ticker := time.NewTicker(debuggerPollInterval)
+	defer ticker.Stop()
+
+	waiting := false
+	for {
+		p.mu.Lock()
+		alive := p.alive()
+		var pid int
+		if alive {
+			pid = p.cmd.Process.Pid
+		}
+		p.mu.Unlock()
+
+		if !alive || traced(pid) {
+			if waiting {
+				log.Printf("[%s] debugger attached", p.id)
+			}
+			return nil
+		}
+
+		if !waiting {
+			log.Printf("[%s] waiting for a debugger to attach to process group %d", p.id, pid)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[%s] stopped waiting for a debugger", p.id)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Freeze suspends the command and the processes it started, like Lambda does
+// between invocations.
+func (p *Process) Freeze() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state == running && p.alive() {
+		if err := p.signal(syscall.SIGSTOP); err != nil {
+			log.Printf("[%s] process freeze failed: %+v", p.id, err)
+		}
+	}
+}
+
+// Thaw resumes the command frozen by Freeze.
+func (p *Process) Thaw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.alive() {
+		if err := p.signal(syscall.SIGCONT); err != nil {
+			log.Printf("[%s] process thaw failed: %+v", p.id, err)
+		}
+	}
+}
+
 func (p *Process) sendKillSignal() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.cmd != nil && p.cmd.Process != nil && p.cmd.ProcessState == nil {
-		p.cmd.Process.Kill()
+	if p.alive() {
+		p.signal(syscall.SIGKILL)
+	}
+}
+
+// alive reports whether the command or any process it started still holds
+// its output open. The caller must hold p.mu.
+func (p *Process) alive() bool {
+	if p.cmd == nil || p.cmd.Process == nil || p.doneCh == nil {
+		return false
 	}
+
+	select {
+	case <-p.doneCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// signal sends the signal to the process group of the command, so processes
+// started by wrapper scripts receive it as well. The caller must hold p.mu.
+func (p *Process) signal(sig syscall.Signal) error {
+	err := syscall.Kill(-p.cmd.Process.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+
+	return err
 }
@@ -0,0 +1,161 @@
+package process
+
+import (
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// Sandbox is what the processes of one execution environment share: the
+// runtime and its extensions see the same environment variables, temporary
+// directory and resource limits, like in Lambda.
+type Sandbox struct {
+	mu sync.Mutex
+
+	id      string
+	env     []string
+	user    *config.User
+	limits  *limits
+	storage *storage
+	pids    map[int]struct{}
+}
+
+func NewSandbox(id string, cfg config.Config, rapi config.ListenAddress) *Sandbox {
+	sandbox := &Sandbox{
+		id:   id,
+		env:  Environment(cfg, rapi),
+		user: cfg.RunAs,
+		pids: make(map[int]struct{}),
+	}
+
+	if storage, err := newStorage(id, cfg); err != nil {
+		log.Printf("[%s] cannot create ephemeral storage, using the temporary directory of the system: %+v", id, err)
+	} else {
+		sandbox.storage = storage
+		sandbox.env = append(sandbox.env, "TMPDIR="+storage.dir)
+	}
+
+	if cfg.EnforceMemorySize || cfg.ThrottleCPU {
+		sandbox.limits = newLimits(id, cfg)
+	}
+
+	return sandbox
+}
+
+// prepare configures the command to run inside the sandbox. The returned
+// function has to be called once the command is started.
+func (s *Sandbox) prepare(cmd *exec.Cmd) (func(), error) {
+	cmd.Env = s.env
+
+	if s.user != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    s.user.UID,
+			Gid:    s.user.GID,
+			Groups: []uint32{},
+		}
+	}
+
+	applied := func() {}
+	if s.limits != nil {
+		s.mu.Lock()
+		var err error
+		applied, err = s.limits.apply(cmd)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func() {
+		applied()
+		if cmd.Process != nil {
+			s.mu.Lock()
+			s.pids[cmd.Process.Pid] = struct{}{}
+			s.mu.Unlock()
+		}
+	}, nil
+}
+
+// exited forgets a process of the sandbox.
+func (s *Sandbox) exited(cmd *exec.Cmd) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pids, cmd.Process.Pid)
+}
+
+// outOfMemory tells whether a process of the sandbox was killed for exceeding
+// the memory limit since the last call.
+func (s *Sandbox) outOfMemory() bool {
+	if s.limits == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.limits.outOfMemory()
+}
+
+// MaxMemoryUsed returns the peak memory usage of the sandbox in bytes. It is
+// measured by the cgroup of the sandbox when there is one, otherwise it is the
+// sum of the peak resident set size of its running processes.
+func (s *Sandbox) MaxMemoryUsed() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limits != nil {
+		if peak, ok := s.limits.peakMemory(); ok {
+			return peak
+		}
+	}
+
+	var used uint64
+	for pid := range s.pids {
+		used += peakResidentSetSize(pid)
+	}
+
+	return used
+}
+
+// OnStorageExceeded registers a function called periodically while the
+// ephemeral storage of the sandbox is above its limit.
+func (s *Sandbox) OnStorageExceeded(exceeded func(used uint64)) {
+	if s.storage != nil {
+		s.storage.onExceeded(exceeded)
+	}
+}
+
+// Reset prepares the sandbox for a new execution environment once all of its
+// processes are killed: the ephemeral storage is emptied and the cgroup is
+// replaced, so the next environment starts with an empty /tmp and its peak
+// memory usage is measured from zero.
+func (s *Sandbox) Reset() {
+	if s.storage != nil {
+		s.storage.wipe()
+	}
+
+	if s.limits != nil {
+		s.mu.Lock()
+		s.limits.renew()
+		s.mu.Unlock()
+	}
+}
+
+// Release frees the resources of the sandbox once all of its processes are
+// stopped.
+func (s *Sandbox) Release() {
+	if s.limits != nil {
+		s.limits.release()
+	}
+
+	if s.storage != nil {
+		s.storage.release()
+	}
+}
@@ -0,0 +1,160 @@
+package process
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+const storagePollInterval = time.Second
+
+// storage is the private temporary directory of an execution environment,
+// emulating the /tmp of Lambda with its ephemeral storage limit. The limit is
+// enforced by a tmpfs when crie can mount one, otherwise the size of the
+// directory is polled and reported when it goes above the limit.
+type storage struct {
+	mu sync.Mutex
+
+	id       string
+	dir      string
+	limit    uint64
+	mounted  bool
+	exceeded func(used uint64)
+	ticker   *time.Ticker
+	doneCh   chan struct{}
+	over     bool
+}
+
+// newStorage creates the directory and mounts a tmpfs on it, or starts
+// polling its size. The directory is owned by the user the processes run as.
+func newStorage(id string, cfg config.Config) (*storage, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("crie-%d-%s", os.Getpid(), strings.ReplaceAll(id, "/", "-")))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	if cfg.RunAs != nil {
+		if err := os.Chown(dir, int(cfg.RunAs.UID), int(cfg.RunAs.GID)); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	s := &storage{
+		id:     id,
+		dir:    dir,
+		limit:  uint64(cfg.EphemeralStorageSize) * 1024 * 1024,
+		doneCh: make(chan struct{}),
+	}
+
+	if err := mountTmpfs(dir, s.limit, cfg.RunAs); err != nil {
+		log.Printf("[%s] cannot mount tmpfs for ephemeral storage, polling its size instead: %+v", id, err)
+		s.ticker = time.NewTicker(storagePollInterval)
+		go s.poll()
+	} else {
+		s.mounted = true
+		log.Printf("[%s] ephemeral storage %s is limited to %d MB by tmpfs", id, dir, cfg.EphemeralStorageSize)
+	}
+
+	return s, nil
+}
+
+func (s *storage) poll() {
+	for {
+		select {
+		case <-s.doneCh:
+			return
+		case <-s.ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check reports the storage when its size goes above the limit, and keeps
+// reporting it until it is wiped.
+func (s *storage) check() {
+	used := directorySize(s.dir)
+
+	s.mu.Lock()
+	over := used > s.limit
+	if over && !s.over {
+		log.Printf("[%s] ephemeral storage %s uses %d MB, more than the limit of %d MB", s.id, s.dir, used/(1024*1024), s.limit/(1024*1024))
+	}
+	s.over = over
+	exceeded := s.exceeded
+	s.mu.Unlock()
+
+	if over && exceeded != nil {
+		exceeded(used)
+	}
+}
+
+func (s *storage) onExceeded(exceeded func(used uint64)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exceeded = exceeded
+}
+
+// wipe removes everything from the directory, like the /tmp of a new
+// execution environment.
+func (s *storage) wipe() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("[%s] cannot read ephemeral storage %s: %+v", s.id, s.dir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(s.dir, entry.Name())); err != nil {
+			log.Printf("[%s] cannot wipe ephemeral storage %s: %+v", s.id, s.dir, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.over = false
+	s.mu.Unlock()
+}
+
+func (s *storage) release() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	close(s.doneCh)
+
+	if s.mounted {
+		if err := unmountTmpfs(s.dir); err != nil {
+			log.Printf("[%s] cannot unmount ephemeral storage %s: %+v", s.id, s.dir, err)
+		}
+	}
+
+	if err := os.RemoveAll(s.dir); err != nil {
+		log.Printf("[%s] cannot remove ephemeral storage %s: %+v", s.id, s.dir, err)
+	}
+}
+
+// directorySize sums the size of the regular files under the directory.
+// Files removed while walking are skipped.
+func directorySize(dir string) uint64 {
+	var size uint64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+
+		if info, err := entry.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return size
+}
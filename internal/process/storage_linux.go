@@ -0,0 +1,24 @@
+package process
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// mountTmpfs mounts a tmpfs of the size of the limit on the directory, so
+// writes above the limit fail with ENOSPC like on Lambda. It requires
+// CAP_SYS_ADMIN, and the mount is made in the mount namespace of crie.
+func mountTmpfs(dir string, limit uint64, user *config.User) error {
+	options := fmt.Sprintf("size=%d,mode=0700", limit)
+	if user != nil {
+		options += fmt.Sprintf(",uid=%d,gid=%d", user.UID, user.GID)
+	}
+
+	return syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, options)
+}
+
+func unmountTmpfs(dir string) error {
+	return syscall.Unmount(dir, syscall.MNT_DETACH)
+}
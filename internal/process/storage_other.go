@@ -0,0 +1,19 @@
+//go:build !linux
+
+package process
+
+import (
+	"errors"
+
+	"github.com/kbertalan/crie/internal/config"
+)
+
+// mountTmpfs is not supported outside of Linux, the size of the directory is
+// polled instead.
+func mountTmpfs(dir string, limit uint64, user *config.User) error {
+	return errors.ErrUnsupported
+}
+
+func unmountTmpfs(dir string) error {
+	return nil
+}
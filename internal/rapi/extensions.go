@@ -0,0 +1,243 @@
+package rapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kbertalan/crie/internal/sender"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	LambdaExtensionName              = "Lambda-Extension-Name"
+	LambdaExtensionIdentifier        = "Lambda-Extension-Identifier"
+	LambdaExtensionEventIdentifier   = "Lambda-Extension-Event-Identifier"
+	LambdaExtensionFunctionErrorType = "Lambda-Extension-Function-Error-Type"
+
+	ExtensionEventInvoke   = "INVOKE"
+	ExtensionEventShutdown = "SHUTDOWN"
+
+	ShutdownReasonSpindown = "spindown"
+
+	extensionEventBufferSize = 16
+)
+
+type extension struct {
+	id     string
+	name   string
+	events []string
+
+	eventCh      chan extensionEvent
+	parked       bool
+	shutdownSent bool
+	shutdownDone bool
+}
+
+type extensionRegisterRequest struct {
+	Events []string `json:"events"`
+}
+
+type extensionRegisterResponse struct {
+	FunctionName    string `json:"functionName"`
+	FunctionVersion string `json:"functionVersion"`
+	Handler         string `json:"handler"`
+}
+
+type extensionEvent struct {
+	EventType          string                  `json:"eventType"`
+	DeadlineMs         int64                   `json:"deadlineMs"`
+	RequestID          string                  `json:"requestId,omitempty"`
+	InvokedFunctionArn string                  `json:"invokedFunctionArn,omitempty"`
+	Tracing            *telemetry.TraceContext `json:"tracing,omitempty"`
+	ShutdownReason     string                  `json:"shutdownReason,omitempty"`
+}
+
+func (e *extension) subscribed(eventType string) bool {
+	return slices.Contains(e.events, eventType)
+}
+
+func (s *Server) acknowledgeShutdown(ext *extension) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !ext.shutdownSent || ext.shutdownDone {
+		return
+	}
+
+	ext.shutdownDone = true
+	s.shutdownPending--
+	if s.shutdownPending == 0 {
+		close(s.shutdownCh)
+	}
+}
+
+// Shutdown sends a SHUTDOWN event to every extension subscribed to it. The
+// returned channel is closed once all of them asked for their next event,
+// which is how extensions signal that they finished their cleanup.
+func (s *Server) Shutdown() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.shutdownCh = make(chan struct{})
+	s.shutdownPending = 0
+
+	deadline := time.Now().Add(s.cfg.ExtensionShutdownTimeout)
+	for _, ext := range s.extensions {
+		if !ext.subscribed(ExtensionEventShutdown) {
+			continue
+		}
+
+		if s.dispatchExtensionEvent(ext, extensionEvent{
+			EventType:      ExtensionEventShutdown,
+			DeadlineMs:     deadline.UnixMilli(),
+			ShutdownReason: ShutdownReasonSpindown,
+		}) {
+			s.shutdownPending++
+		}
+	}
+
+	if s.shutdownPending == 0 {
+		close(s.shutdownCh)
+	}
+
+	return s.shutdownCh
+}
+
+func (s *Server) dispatchInvokeEvent(deadline time.Time) {
+	for _, ext := range s.extensions {
+		if !ext.subscribed(ExtensionEventInvoke) {
+			continue
+		}
+
+		s.dispatchExtensionEvent(ext, extensionEvent{
+			EventType:          ExtensionEventInvoke,
+			DeadlineMs:         deadline.UnixMilli(),
+			RequestID:          s.inv.ID.String(),
+			InvokedFunctionArn: s.cfg.LambdaRuntimeInvokedFunctionArn,
+			Tracing:            telemetry.XRayTraceContext(s.inv.TraceID),
+		})
+	}
+}
+
+func (s *Server) dispatchExtensionEvent(ext *extension, event extensionEvent) bool {
+	select {
+	case ext.eventCh <- event:
+		return true
+	default:
+		log.Printf("[%s] extension %s is not consuming events, dropping %s event", s.id, ext.name, event.EventType)
+		return false
+	}
+}
+
+func (s *Server) serveExtensionRegister(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(LambdaExtensionName)
+	if name == "" {
+		sender.SendMessage(w, http.StatusBadRequest, "missing %s header", LambdaExtensionName)
+		return
+	}
+
+	var req extensionRegisterRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)).Decode(&req); err != nil {
+		sender.SendMessage(w, http.StatusBadRequest, "invalid register request: %+v", err)
+		return
+	}
+
+	for _, event := range req.Events {
+		if event != ExtensionEventInvoke && event != ExtensionEventShutdown {
+			sender.SendMessage(w, http.StatusBadRequest, "unsupported event type: %s", event)
+			return
+		}
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		sender.SendMessage(w, http.StatusInternalServerError, "cannot generate extension identifier: %+v", err)
+		return
+	}
+
+	ext := &extension{
+		id:      id.String(),
+		name:    name,
+		events:  req.Events,
+		eventCh: make(chan extensionEvent, extensionEventBufferSize),
+	}
+
+	s.mu.Lock()
+	s.extensions[ext.id] = ext
+	s.mu.Unlock()
+
+	log.Printf("[%s] extension %s registered for %v", s.id, name, req.Events)
+
+	w.Header().Set(LambdaExtensionIdentifier, ext.id)
+	sender.SendJSON(w, http.StatusOK, extensionRegisterResponse{
+		FunctionName:    s.cfg.LambdaName,
+		FunctionVersion: FunctionVersionLatest,
+		Handler:         s.cfg.LambdaHandler,
+	})
+}
+
+func (s *Server) serveExtensionNext(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.lookupExtension(r)
+	if !ok {
+		sender.SendMessage(w, http.StatusForbidden, "unknown extension identifier")
+		return
+	}
+
+	s.acknowledgeShutdown(ext)
+
+	s.mu.Lock()
+	s.park(&ext.parked, true)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.park(&ext.parked, false)
+	}()
+
+	select {
+	case <-r.Context().Done():
+		return
+	case <-s.ctx.Done():
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	case event := <-ext.eventCh:
+		if event.EventType == ExtensionEventShutdown {
+			s.mu.Lock()
+			ext.shutdownSent = true
+			s.mu.Unlock()
+		}
+
+		eventID, err := uuid.NewRandom()
+		if err != nil {
+			sender.SendMessage(w, http.StatusInternalServerError, "cannot generate event identifier: %+v", err)
+			return
+		}
+
+		w.Header().Set(LambdaExtensionEventIdentifier, eventID.String())
+		sender.SendJSON(w, http.StatusOK, event)
+	}
+}
+
+func (s *Server) serveExtensionError(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.lookupExtension(r)
+	if !ok {
+		sender.SendMessage(w, http.StatusForbidden, "unknown extension identifier")
+		return
+	}
+
+	log.Printf("[%s] extension %s reported %s: %s", s.id, ext.name, r.URL.Path, r.Header.Get(LambdaExtensionFunctionErrorType))
+	sender.SendMessage(w, http.StatusAccepted, "error reported")
+}
+
+func (s *Server) lookupExtension(r *http.Request) (*extension, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ext, ok := s.extensions[r.Header.Get(LambdaExtensionIdentifier)]
+	return ext, ok
+}
@@ -0,0 +1,55 @@
+package rapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/kbertalan/crie/internal/sender"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	defaultLogsMaxItems  = 10000
+	defaultLogsMaxBytes  = 256 * 1024
+	defaultLogsTimeoutMs = 1000
+)
+
+type logsSubscribeRequest struct {
+	Types       []string                `json:"types"`
+	Buffering   telemetry.Buffering     `json:"buffering"`
+	Destination subscriptionDestination `json:"destination"`
+}
+
+func (s *Server) serveLogsSubscribe(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.lookupExtension(r)
+	if !ok {
+		sender.SendMessage(w, http.StatusForbidden, "unknown extension identifier")
+		return
+	}
+
+	req := logsSubscribeRequest{
+		Buffering: telemetry.Buffering{
+			MaxItems:  defaultLogsMaxItems,
+			MaxBytes:  defaultLogsMaxBytes,
+			TimeoutMs: defaultLogsTimeoutMs,
+		},
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)).Decode(&req); err != nil {
+		sender.SendMessage(w, http.StatusBadRequest, "invalid logs subscription: %+v", err)
+		return
+	}
+
+	subscription, err := newSubscription(req.Types, req.Buffering, req.Destination)
+	if err != nil {
+		sender.SendMessage(w, http.StatusBadRequest, "invalid logs subscription: %+v", err)
+		return
+	}
+	subscription.Convert = telemetry.LogsAPIEvent
+
+	s.telemetry.Subscribe("logs/"+ext.id, subscription)
+	log.Printf("[%s] extension %s subscribed to logs %v at %s", s.id, ext.name, req.Types, subscription.URI)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
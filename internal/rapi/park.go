@@ -0,0 +1,75 @@
+package rapi
+
+import (
+	"context"
+)
+
+// WaitParked blocks until the response of the last invocation is sent, and
+// the runtime and every registered extension asks for its next event, which
+// is when Lambda considers the execution environment idle. It returns the
+// error of the context when it is done before.
+func (s *Server) WaitParked(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.state == stopped {
+			s.mu.Unlock()
+			return ErrStopped
+		}
+		parked := s.parked()
+		parkedCh := s.parkedCh
+		s.mu.Unlock()
+
+		if parked {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.ctx.Done():
+			return ErrStopped
+		case <-parkedCh:
+		}
+	}
+}
+
+// parked tells whether the runtime and the extensions are all waiting for
+// their next event. The caller must hold s.mu.
+func (s *Server) parked() bool {
+	if s.state != idle || s.answering || !s.runtimeParked {
+		return false
+	}
+
+	for _, ext := range s.extensions {
+		if !ext.parked || len(ext.eventCh) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// park records whether the runtime or an extension is waiting for its next
+// event, and wakes up WaitParked. The caller must hold s.mu.
+func (s *Server) park(flag *bool, parked bool) {
+	*flag = parked
+	if parked {
+		s.parkedChanged()
+	}
+}
+
+// parkedChanged wakes up WaitParked to check the state again. The caller must
+// hold s.mu.
+func (s *Server) parkedChanged() {
+	close(s.parkedCh)
+	s.parkedCh = make(chan struct{})
+}
+
+// endResponse marks the response handler of the runtime as returned.
+func (s *Server) endResponse() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.answering = false
+	s.parkedChanged()
+}
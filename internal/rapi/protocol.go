@@ -0,0 +1,111 @@
+package rapi
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/kbertalan/crie/internal/invocation"
+	"github.com/kbertalan/crie/internal/sender"
+)
+
+const (
+	ErrorTypeInvalidRequestID       = "InvalidRequestID"
+	ErrorTypeInvalidStateTransition = "InvalidStateTransition"
+
+	maxViolations = 1000
+)
+
+// Violation is a call made by the runtime which does not follow the Runtime
+// API protocol, like answering an invocation that is not in progress.
+type Violation struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	ErrorType string
+	Message   string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s %s %s: %s: %s", v.Time.Format(time.RFC3339Nano), v.Method, v.Path, v.ErrorType, v.Message)
+}
+
+type errorResponse struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// Violations returns the protocol violations of the runtime since the server
+// was created. They are kept across restarts of the execution environment.
+func (s *Server) Violations() []Violation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.violations)
+}
+
+// reject answers a call violating the protocol with the status and error type
+// AWS uses, and records it. The caller must hold s.mu.
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, status int, errorType string, format string, args ...any) {
+	violation := Violation{
+		Time:      time.Now(),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		ErrorType: errorType,
+		Message:   fmt.Sprintf(format, args...),
+	}
+
+	if len(s.violations) < maxViolations {
+		s.violations = append(s.violations, violation)
+	}
+
+	log.Printf("[%s] protocol violation: %s %s: %s", s.id, violation.Method, violation.Path, violation.Message)
+	sender.SendJSON(w, status, errorResponse{
+		ErrorMessage: violation.Message,
+		ErrorType:    errorType,
+	})
+}
+
+// beginResponse checks that the runtime answers the invocation in progress
+// and marks it as being answered, so duplicate answers are rejected.
+func (s *Server) beginResponse(w http.ResponseWriter, r *http.Request) (*invocation.Invocation, bool) {
+	requestID := r.PathValue("requestId")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.inv != nil && s.inv.ID.String() == requestID
+	switch {
+	case current && s.state == busy:
+		s.state = responding
+		s.answering = true
+		return s.inv, true
+	case current && s.state == responding, requestID == s.completedID:
+		s.reject(w, r, http.StatusForbidden, ErrorTypeInvalidStateTransition, "invocation [%s] is already answered", requestID)
+	case s.state != busy:
+		s.reject(w, r, http.StatusBadRequest, ErrorTypeInvalidRequestID, "no invocation is in progress, got [%s]", requestID)
+	default:
+		s.reject(w, r, http.StatusBadRequest, ErrorTypeInvalidRequestID, "invocation in progress is [%s], got [%s]", s.inv.ID, requestID)
+	}
+
+	return nil, false
+}
+
+// finishResponse marks the invocation as completed, making the server ready
+// for the next one.
+func (s *Server) finishResponse(inv *invocation.Invocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inv != inv {
+		return
+	}
+
+	s.disarmDeadline()
+	s.state = idle
+	s.inv = nil
+	s.completedID = inv.ID.String()
+	s.doneCh <- nil
+}
@@ -0,0 +1,44 @@
+package rapi
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+// printStart writes the START line Lambda logs before every invocation. The
+// caller must hold s.mu.
+func (s *Server) printStart() {
+	fmt.Fprintf(os.Stdout, "START RequestId: %s Version: %s\n", s.inv.ID, FunctionVersionLatest)
+}
+
+// printReport writes the END and REPORT lines Lambda logs after every
+// invocation. Init Duration is reported only for the first invocation of an
+// execution environment.
+func (s *Server) printReport(requestID string, status string, metrics telemetry.ReportMetrics) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "END RequestId: %s\n", requestID)
+	fmt.Fprintf(&b, "REPORT RequestId: %s\tDuration: %.2f ms\tBilled Duration: %d ms\tMemory Size: %d MB\tMax Memory Used: %d MB",
+		requestID, metrics.DurationMs, metrics.BilledDurationMs, metrics.MemorySizeMB, metrics.MaxMemoryUsedMB)
+
+	if metrics.InitDurationMs != nil {
+		fmt.Fprintf(&b, "\tInit Duration: %.2f ms", *metrics.InitDurationMs)
+	}
+
+	if status == telemetry.StatusTimeout || status == telemetry.StatusFailure {
+		fmt.Fprintf(&b, "\tStatus: %s", status)
+	}
+
+	b.WriteString("\n")
+	os.Stdout.WriteString(b.String())
+}
+
+func (s *Server) maxMemoryUsed() uint64 {
+	if s.memory == nil {
+		return 0
+	}
+
+	return s.memory()
+}
@@ -3,6 +3,7 @@ package rapi
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"github.com/kbertalan/crie/internal/config"
 	"github.com/kbertalan/crie/internal/invocation"
 	"github.com/kbertalan/crie/internal/sender"
+	"github.com/kbertalan/crie/internal/telemetry"
 )
 
 type Server struct {
@@ -24,13 +26,29 @@ type Server struct {
 	cfg  config.Config
 	rapi config.ListenAddress
 
-	srv       *http.Server
-	state     serverState
-	inv       *invocation.Invocation
-	lastNext  time.Time
-	lastStart time.Time
-	nextCh    chan struct{}
-	doneCh    chan struct{}
+	srv          *http.Server
+	state        serverState
+	inv          *invocation.Invocation
+	lastNext     time.Time
+	lastStart    time.Time
+	initDuration time.Duration
+	initErr      *invocation.FunctionError
+	initTimeout  *time.Timer
+	deadline     *time.Timer
+	nextCh       chan struct{}
+	doneCh       chan error
+	extensions   map[string]*extension
+	telemetry    *telemetry.Hub
+	memory       func() uint64
+	completedID  string
+	violations   []Violation
+
+	runtimeParked bool
+	answering     bool
+	parkedCh      chan struct{}
+
+	shutdownCh      chan struct{}
+	shutdownPending int
 }
 
 type serverState int
@@ -40,8 +58,27 @@ const (
 	initializing
 	idle
 	busy
+	responding
+	failed
 )
 
+const (
+	ErrorTypeInitError = "Runtime.InitError"
+)
+
+var ErrStopped = errors.New("rapi.server stopped")
+
+// InitError is returned by Next when the runtime reported an initialization
+// error. The invocation is not answered in this case, so it can be retried on
+// a new execution environment.
+type InitError struct {
+	Err *invocation.FunctionError
+}
+
+func (e *InitError) Error() string {
+	return fmt.Sprintf("initialization failed: %s", e.Err)
+}
+
 const (
 	LambdaRuntimeAwsRequestID       = "Lambda-Runtime-Aws-Request-Id"
 	LambdaRuntimeDeadlineMs         = "Lambda-Runtime-Deadline-Ms"
@@ -51,13 +88,20 @@ const (
 	LambdaRuntimeCognitoIdentity    = "Lambda-Runtime-Cognito-Identity"
 	ContentType                     = "Content-Type"
 	ContentTypeApplicationJSON      = "application/json"
+
+	FunctionVersionLatest = "$LATEST"
 )
 
-func NewServer(id string, cfg config.Config, rapi config.ListenAddress) *Server {
+// NewServer creates the Runtime API of one execution environment. The memory
+// function returns the peak memory usage of the environment in bytes, which
+// is reported after every invocation.
+func NewServer(id string, cfg config.Config, rapi config.ListenAddress, hub *telemetry.Hub, memory func() uint64) *Server {
 	return &Server{
-		id:   id,
-		cfg:  cfg,
-		rapi: rapi,
+		id:        id,
+		cfg:       cfg,
+		rapi:      rapi,
+		telemetry: hub,
+		memory:    memory,
 	}
 }
 
@@ -74,6 +118,12 @@ func (s *Server) Start() {
 	mux.HandleFunc("POST /2018-06-01/runtime/init/error", s.serveInitializationError)
 	mux.HandleFunc("POST /2018-06-01/runtime/invocation/{requestId}/response", s.serveInvocationResponse)
 	mux.HandleFunc("POST /2018-06-01/runtime/invocation/{requestId}/error", s.serveInvocationError)
+	mux.HandleFunc("POST /2020-01-01/extension/register", s.serveExtensionRegister)
+	mux.HandleFunc("GET /2020-01-01/extension/event/next", s.serveExtensionNext)
+	mux.HandleFunc("POST /2020-01-01/extension/init/error", s.serveExtensionError)
+	mux.HandleFunc("POST /2020-01-01/extension/exit/error", s.serveExtensionError)
+	mux.HandleFunc("PUT /2020-08-15/logs", s.serveLogsSubscribe)
+	mux.HandleFunc("PUT /2022-07-01/telemetry", s.serveTelemetrySubscribe)
 
 	s.srv = &http.Server{
 		Addr:                         string(s.rapi),
@@ -90,7 +140,16 @@ func (s *Server) Start() {
 	s.cancel = cancel
 	s.lastStart = time.Now()
 	s.nextCh = make(chan struct{}, 1)
-	s.doneCh = make(chan struct{}, 1)
+	s.doneCh = make(chan error, 1)
+	s.parkedCh = make(chan struct{})
+	s.runtimeParked = false
+	s.answering = false
+	s.extensions = make(map[string]*extension)
+	s.initDuration = 0
+	s.initErr = nil
+	s.telemetry.Reset()
+	s.publishInitStart()
+	s.armInitTimeout()
 
 	go func() {
 		err := s.srv.ListenAndServe()
@@ -126,6 +185,8 @@ func (s *Server) Stop() {
 	}
 
 	s.cancel()
+	s.disarmInitTimeout()
+	s.disarmDeadline()
 	s.mu.Unlock()
 
 	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ServerShutdownTimeout)
@@ -138,7 +199,7 @@ func (s *Server) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.inv != nil {
+	if s.inv != nil && s.state != responding {
 		log.Printf("[%s] rapi.server had a pending invocation [%s], sending error", s.id, s.inv.ID)
 		s.sendInvocationError(http.StatusInternalServerError, "server shutdown")
 	}
@@ -146,19 +207,34 @@ func (s *Server) Stop() {
 	s.srv = nil
 	s.state = stopped
 	s.inv = nil
+	s.telemetry.Reset()
 
 	log.Printf("[%s] rapi.server stopped", s.id)
 }
 
-func (s *Server) Next(inv invocation.Invocation) {
+// Next hands the invocation over to the runtime and waits until it is
+// completed. It returns an *InitError when the initialization of the runtime
+// failed, either before or during the invocation, and ErrTimeout when the
+// runtime did not complete the invocation in time. The deadline starts when
+// the runtime receives the invocation, so the initialization is limited by
+// the init timeout only.
+func (s *Server) Next(inv invocation.Invocation) error {
 	s.mu.Lock()
+	if s.state == failed {
+		err := &InitError{Err: s.initErr}
+		s.mu.Unlock()
+		return err
+	}
+
 	s.inv = &inv
 	s.nextCh <- struct{}{}
 	s.mu.Unlock()
 
 	select {
 	case <-s.ctx.Done():
-	case <-s.doneCh:
+		return ErrStopped
+	case err := <-s.doneCh:
+		return err
 	}
 }
 
@@ -173,12 +249,26 @@ func (s *Server) sendInvocationError(status int, format string, args ...any) {
 
 func (s *Server) serveNext(w http.ResponseWriter, r *http.Request) {
 	s.mu.Lock()
-	if s.state == initializing {
-		log.Printf("[%s] initialization took %s", s.id, time.Since(s.lastStart))
+	switch s.state {
+	case initializing:
+		s.initDuration = time.Since(s.lastStart)
+		log.Printf("[%s] initialization took %s", s.id, s.initDuration)
+		s.disarmInitTimeout()
 		s.state = idle
+	case busy, responding:
+		s.reject(w, r, http.StatusForbidden, ErrorTypeInvalidStateTransition, "invocation [%s] is still in progress", s.inv.ID)
+		s.mu.Unlock()
+		return
 	}
+	s.park(&s.runtimeParked, true)
 	s.mu.Unlock()
 
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.park(&s.runtimeParked, false)
+	}()
+
 	ctx := r.Context()
 	select {
 	case <-ctx.Done():
@@ -196,10 +286,15 @@ func (s *Server) serveNext(w http.ResponseWriter, r *http.Request) {
 		defer s.mu.Unlock()
 		s.state = busy
 		s.lastNext = time.Now()
+		deadline := s.lastNext.Add(s.cfg.LambdaRuntimeDeadline)
+		s.armDeadline(s.inv, s.cfg.LambdaRuntimeDeadline)
 
 		target := w.Header()
 		s.copyHeadersFromInvocation(target)
-		s.prepareLambdaHeaders(target)
+		s.prepareLambdaHeaders(target, deadline)
+		s.dispatchInvokeEvent(deadline)
+		s.publishStart()
+		s.printStart()
 
 		w.WriteHeader(http.StatusOK)
 		w.Write(s.inv.Request.Body)
@@ -223,7 +318,7 @@ func (s *Server) copyHeadersFromInvocation(target http.Header) {
 	}
 }
 
-func (s *Server) prepareLambdaHeaders(target http.Header) {
+func (s *Server) prepareLambdaHeaders(target http.Header, deadline time.Time) {
 	if s.inv == nil {
 		return
 	}
@@ -232,19 +327,23 @@ func (s *Server) prepareLambdaHeaders(target http.Header) {
 	target.Add(LambdaRuntimeAwsRequestID, s.inv.ID.String())
 
 	target.Del(LambdaRuntimeDeadlineMs)
-	target.Add(LambdaRuntimeDeadlineMs, strconv.FormatInt(time.Now().Add(s.cfg.LambdaRuntimeDeadline).UnixMilli(), 10))
+	target.Add(LambdaRuntimeDeadlineMs, strconv.FormatInt(deadline.UnixMilli(), 10))
 
 	target.Del(LambdaRuntimeInvokedFunctionArn)
 	target.Add(LambdaRuntimeInvokedFunctionArn, s.cfg.LambdaRuntimeInvokedFunctionArn)
 
 	target.Del(LambdaRuntimeTraceId)
-	// TODO set trace id
+	target.Add(LambdaRuntimeTraceId, s.inv.TraceID)
 
 	target.Del(LambdaRuntimeClientContext)
-	// TODO set client context
+	if s.inv.ClientContext != "" {
+		target.Add(LambdaRuntimeClientContext, s.inv.ClientContext)
+	}
 
 	target.Del(LambdaRuntimeCognitoIdentity)
-	// TODO set cognito identity
+	if s.cfg.LambdaCognitoIdentity != "" {
+		target.Add(LambdaRuntimeCognitoIdentity, s.cfg.LambdaCognitoIdentity)
+	}
 
 	if target.Get(ContentType) == "" {
 		target.Add(ContentType, ContentTypeApplicationJSON)
@@ -252,90 +351,125 @@ func (s *Server) prepareLambdaHeaders(target http.Header) {
 }
 
 func (s *Server) serveInitializationError(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize))
 	if err != nil {
 		log.Printf("[%s] could not read initialization error response: %+v", s.id, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	log.Printf("[%s] initialization error: %s", s.id, string(body))
+
+	errorType := r.Header.Get(LambdaRuntimeFunctionErrorType)
+	if errorType == "" {
+		errorType = ErrorTypeInitError
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != initializing {
+		s.reject(w, r, http.StatusForbidden, ErrorTypeInvalidStateTransition, "runtime is already initialized")
+		return
+	}
+
+	s.failInit(invocation.NewFunctionError(errorType, body))
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// failInit marks the initialization failed and hands the error over to the
+// invocation waiting for the runtime, if any. The caller must hold s.mu.
+func (s *Server) failInit(fnErr *invocation.FunctionError) {
+	s.state = failed
+	s.initErr = fnErr
+	s.disarmInitTimeout()
+
+	if s.inv != nil {
+		select {
+		case <-s.nextCh:
+		default:
+		}
+
+		s.disarmDeadline()
+		s.inv = nil
+		s.doneCh <- &InitError{Err: s.initErr}
+	}
+}
+
 func (s *Server) serveInvocationError(w http.ResponseWriter, r *http.Request) {
-	if s.inv == nil {
-		sender.SendMessage(w, http.StatusBadRequest, "no active invocation")
+	inv, ok := s.beginResponse(w, r)
+	if !ok {
 		return
 	}
+	defer s.endResponse()
 
 	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)
 	if body, err := io.ReadAll(r.Body); err == nil {
 		w.WriteHeader(http.StatusAccepted)
-
-		s.inv.ResponseCh <- invocation.Response{
-			StatusCode: http.StatusBadGateway,
-			Header:     nil,
-			Body:       body,
-			Error:      errors.New(string(body)),
+		s.publishInvocationDone(telemetry.StatusError, len(body))
+
+		if s.cfg.LegacyFunctionErrors {
+			inv.ResponseCh <- invocation.Response{
+				StatusCode: http.StatusBadGateway,
+				Header:     nil,
+				Body:       body,
+				Error:      errors.New(string(body)),
+			}
+		} else {
+			inv.ResponseCh <- invocation.ResponseFunctionError(invocation.NewFunctionError(r.Header.Get(LambdaRuntimeFunctionErrorType), body))
 		}
 
-		log.Printf("[%s] invocation [%s] failed after %s", s.id, s.inv.ID, time.Since(s.lastNext))
+		log.Printf("[%s] invocation [%s] failed after %s", s.id, inv.ID, time.Since(s.lastNext))
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 
 		resp := invocation.ResponseMessage(http.StatusInternalServerError, "could not read lambda invocation error response")
 		resp.Error = err
 
-		s.inv.ResponseCh <- resp
+		inv.ResponseCh <- resp
 
-		log.Printf("[%s] could not read invocation [%s] error response: %+v", s.id, s.inv.ID, err)
-	}
-
-	close(s.inv.ResponseCh)
-	s.doneCh <- struct{}{}
+		s.publishInvocationDone(telemetry.StatusFailure, 0)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+		log.Printf("[%s] could not read invocation [%s] error response: %+v", s.id, inv.ID, err)
+	}
 
-	s.state = idle
-	s.inv = nil
+	close(inv.ResponseCh)
+	s.finishResponse(inv)
 }
 
 func (s *Server) serveInvocationResponse(w http.ResponseWriter, r *http.Request) {
-	if s.inv == nil {
-		sender.SendMessage(w, http.StatusBadRequest, "no active invocation")
+	inv, ok := s.beginResponse(w, r)
+	if !ok {
 		return
 	}
+	defer s.endResponse()
 
-	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)
-	if body, err := io.ReadAll(r.Body); err == nil {
+	if r.Header.Get(LambdaRuntimeFunctionResponseMode) == ResponseModeStreaming {
+		s.streamInvocationResponse(w, r, inv)
+	} else if body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)); err == nil {
 		w.WriteHeader(http.StatusAccepted)
+		s.publishInvocationDone(telemetry.StatusSuccess, len(body))
 
-		s.inv.ResponseCh <- invocation.Response{
+		inv.ResponseCh <- invocation.Response{
 			StatusCode: http.StatusOK,
 			Header:     nil,
 			Body:       body,
 			Error:      nil,
 		}
 
-		log.Printf("[%s] invocation [%s] completed in %s", s.id, s.inv.ID, time.Since(s.lastNext))
+		log.Printf("[%s] invocation [%s] completed in %s", s.id, inv.ID, time.Since(s.lastNext))
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 
 		resp := invocation.ResponseJSON(http.StatusInternalServerError, "cannot read lambda invocation response")
 		resp.Error = err
 
-		s.inv.ResponseCh <- resp
+		inv.ResponseCh <- resp
 
-		log.Printf("[%s] could not read invocation [%s] response: %+v", s.id, s.inv.ID, err)
-	}
-
-	close(s.inv.ResponseCh)
-	s.doneCh <- struct{}{}
+		s.publishInvocationDone(telemetry.StatusFailure, 0)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+		log.Printf("[%s] could not read invocation [%s] response: %+v", s.id, inv.ID, err)
+	}
 
-	s.state = idle
-	s.inv = nil
+	close(inv.ResponseCh)
+	s.finishResponse(inv)
 }
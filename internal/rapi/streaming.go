@@ -0,0 +1,73 @@
+package rapi
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kbertalan/crie/internal/invocation"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	LambdaRuntimeFunctionResponseMode = "Lambda-Runtime-Function-Response-Mode"
+	LambdaRuntimeFunctionErrorType    = "Lambda-Runtime-Function-Error-Type"
+	LambdaRuntimeFunctionErrorBody    = "Lambda-Runtime-Function-Error-Body"
+
+	ResponseModeStreaming       = "streaming"
+	ContentTypeApplicationOctet = "application/octet-stream"
+)
+
+// streamInvocationResponse forwards the chunks of a streamed response to the
+// invocation while they arrive. Errors happening after the stream started are
+// reported by the runtime in the error type and body trailers.
+func (s *Server) streamInvocationResponse(w http.ResponseWriter, r *http.Request, inv *invocation.Invocation) {
+	contentType := r.Header.Get(ContentType)
+	if contentType == "" {
+		contentType = ContentTypeApplicationOctet
+	}
+
+	reader, writer := io.Pipe()
+	inv.ResponseCh <- invocation.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			ContentType: []string{contentType},
+		},
+		Stream: reader,
+	}
+
+	n, err := io.Copy(writer, http.MaxBytesReader(w, r.Body, s.cfg.MaxStreamingBodySize))
+	if err != nil {
+		writer.CloseWithError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		s.publishInvocationDone(telemetry.StatusFailure, int(n))
+
+		log.Printf("[%s] could not stream invocation [%s] response: %+v", s.id, inv.ID, err)
+		return
+	}
+
+	if errorType := r.Trailer.Get(LambdaRuntimeFunctionErrorType); errorType != "" {
+		body, decodeErr := base64.StdEncoding.DecodeString(r.Trailer.Get(LambdaRuntimeFunctionErrorBody))
+		if decodeErr != nil {
+			body = []byte(r.Trailer.Get(LambdaRuntimeFunctionErrorBody))
+		}
+
+		writer.CloseWithError(&invocation.StreamError{
+			Type: errorType,
+			Body: body,
+		})
+		w.WriteHeader(http.StatusAccepted)
+		s.publishInvocationDone(telemetry.StatusError, int(n))
+
+		log.Printf("[%s] invocation [%s] stream failed after %s", s.id, inv.ID, time.Since(s.lastNext))
+		return
+	}
+
+	writer.Close()
+	w.WriteHeader(http.StatusAccepted)
+	s.publishInvocationDone(telemetry.StatusSuccess, int(n))
+
+	log.Printf("[%s] invocation [%s] streamed in %s", s.id, inv.ID, time.Since(s.lastNext))
+}
@@ -0,0 +1,163 @@
+package rapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/kbertalan/crie/internal/sender"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	defaultTelemetryMaxItems  = 1000
+	defaultTelemetryMaxBytes  = 256 * 1024
+	defaultTelemetryTimeoutMs = 1000
+)
+
+type subscriptionDestination struct {
+	Protocol string `json:"protocol"`
+	URI      string `json:"URI"`
+}
+
+type telemetrySubscribeRequest struct {
+	SchemaVersion string                  `json:"schemaVersion"`
+	Types         []string                `json:"types"`
+	Buffering     telemetry.Buffering     `json:"buffering"`
+	Destination   subscriptionDestination `json:"destination"`
+}
+
+func (s *Server) serveTelemetrySubscribe(w http.ResponseWriter, r *http.Request) {
+	ext, ok := s.lookupExtension(r)
+	if !ok {
+		sender.SendMessage(w, http.StatusForbidden, "unknown extension identifier")
+		return
+	}
+
+	req := telemetrySubscribeRequest{
+		Buffering: telemetry.Buffering{
+			MaxItems:  defaultTelemetryMaxItems,
+			MaxBytes:  defaultTelemetryMaxBytes,
+			TimeoutMs: defaultTelemetryTimeoutMs,
+		},
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodySize)).Decode(&req); err != nil {
+		sender.SendMessage(w, http.StatusBadRequest, "invalid telemetry subscription: %+v", err)
+		return
+	}
+
+	subscription, err := newSubscription(req.Types, req.Buffering, req.Destination)
+	if err != nil {
+		sender.SendMessage(w, http.StatusBadRequest, "invalid telemetry subscription: %+v", err)
+		return
+	}
+
+	s.telemetry.Subscribe("telemetry/"+ext.id, subscription)
+	log.Printf("[%s] extension %s subscribed to telemetry %v at %s", s.id, ext.name, req.Types, subscription.URI)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func newSubscription(types []string, buffering telemetry.Buffering, destination subscriptionDestination) (telemetry.Subscription, error) {
+	var subscription telemetry.Subscription
+
+	for _, t := range types {
+		switch t {
+		case telemetry.CategoryPlatform, telemetry.CategoryFunction, telemetry.CategoryExtension:
+		default:
+			return subscription, fmt.Errorf("unsupported type: %s", t)
+		}
+	}
+
+	if err := buffering.Validate(); err != nil {
+		return subscription, err
+	}
+
+	uri, err := telemetry.DestinationURI(destination.Protocol, destination.URI)
+	if err != nil {
+		return subscription, err
+	}
+
+	subscription.Categories = types
+	subscription.Buffering = buffering
+	subscription.URI = uri
+
+	return subscription, nil
+}
+
+func (s *Server) publishInitStart() {
+	s.telemetry.Publish(telemetry.TypePlatformInitStart, telemetry.PlatformInitStart{
+		InitializationType: telemetry.InitializationTypeOnDemand,
+		Phase:              telemetry.PhaseInit,
+		FunctionName:       s.cfg.LambdaName,
+		FunctionVersion:    FunctionVersionLatest,
+	})
+}
+
+func (s *Server) publishStart() {
+	s.telemetry.Publish(telemetry.TypePlatformStart, telemetry.PlatformStart{
+		RequestID: s.inv.ID.String(),
+		Version:   FunctionVersionLatest,
+		Tracing:   telemetry.XRayTraceContext(s.inv.TraceID),
+	})
+}
+
+func (s *Server) publishInvocationDone(status string, producedBytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reportInvocationDone(status, producedBytes)
+}
+
+// reportInvocationDone publishes the end of the current invocation. The caller
+// must hold s.mu.
+func (s *Server) reportInvocationDone(status string, producedBytes int) {
+	if s.inv == nil {
+		return
+	}
+
+	duration := time.Since(s.lastNext)
+	requestID := s.inv.ID.String()
+
+	s.telemetry.Publish(telemetry.TypePlatformRuntimeDone, telemetry.PlatformRuntimeDone{
+		RequestID: requestID,
+		Status:    status,
+		Metrics: telemetry.RuntimeDoneMetrics{
+			DurationMs:    milliseconds(duration),
+			ProducedBytes: producedBytes,
+		},
+	})
+
+	metrics := telemetry.ReportMetrics{
+		DurationMs:       milliseconds(duration),
+		BilledDurationMs: int64(math.Ceil(milliseconds(duration))),
+		MemorySizeMB:     s.cfg.LambdaMemorySize,
+		MaxMemoryUsedMB:  megabytes(s.maxMemoryUsed()),
+	}
+
+	if s.initDuration > 0 {
+		initDurationMs := milliseconds(s.initDuration)
+		metrics.InitDurationMs = &initDurationMs
+		s.initDuration = 0
+	}
+
+	s.telemetry.Publish(telemetry.TypePlatformReport, telemetry.PlatformReport{
+		RequestID: requestID,
+		Status:    status,
+		Metrics:   metrics,
+	})
+
+	s.printReport(requestID, status, metrics)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d.Microseconds())/10) / 100
+}
+
+func megabytes(bytes uint64) uint64 {
+	return (bytes + 1024*1024 - 1) / (1024 * 1024)
+}
@@ -0,0 +1,148 @@
+package rapi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/kbertalan/crie/internal/invocation"
+	"github.com/kbertalan/crie/internal/telemetry"
+)
+
+const (
+	ErrorTypeTimedOut    = "Sandbox.Timedout"
+	ErrorTypeOutOfMemory = "Runtime.OutOfMemory"
+	ErrorTypeExitError   = "Runtime.ExitError"
+	ErrorTypeInitTimeout = "Runtime.InitTimeout"
+
+	ErrorTypeExtensionCrash  = "Extension.Crash"
+	ErrorTypeStorageExceeded = "Sandbox.EphemeralStorageExceeded"
+)
+
+// ErrTimeout is returned by Next when the runtime did not complete the
+// invocation before its deadline. The invocation is answered with a timeout
+// error, but the runtime may still be working on it, so the execution
+// environment has to be recycled.
+var ErrTimeout = errors.New("invocation timed out")
+
+// RuntimeError is returned by Next when the execution environment failed
+// during the invocation, like the runtime being killed for exceeding the
+// memory limit. The invocation is answered with the error already.
+type RuntimeError struct {
+	Err *invocation.FunctionError
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("runtime failed: %s", e.Err)
+}
+
+// armInitTimeout starts the timer which fails the initialization when the
+// runtime does not ask for its first invocation in time. The caller must hold
+// s.mu.
+func (s *Server) armInitTimeout() {
+	s.disarmInitTimeout()
+
+	started := s.lastStart
+	s.initTimeout = time.AfterFunc(s.cfg.LambdaInitTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.state != initializing || s.lastStart != started {
+			return
+		}
+
+		log.Printf("[%s] initialization timed out after %s", s.id, s.cfg.LambdaInitTimeout)
+		s.failInit(&invocation.FunctionError{
+			ErrorMessage: fmt.Sprintf("Init timed out after %.2f seconds", s.cfg.LambdaInitTimeout.Seconds()),
+			ErrorType:    ErrorTypeInitTimeout,
+		})
+	})
+}
+
+// disarmInitTimeout stops the timer of the initialization. The caller must
+// hold s.mu.
+func (s *Server) disarmInitTimeout() {
+	if s.initTimeout != nil {
+		s.initTimeout.Stop()
+		s.initTimeout = nil
+	}
+}
+
+// armDeadline starts the timer which expires the invocation, replacing the
+// timer of any previous invocation. The caller must hold s.mu.
+func (s *Server) armDeadline(inv *invocation.Invocation, timeout time.Duration) {
+	s.disarmDeadline()
+	s.deadline = time.AfterFunc(timeout, func() {
+		s.expire(inv)
+	})
+}
+
+// disarmDeadline stops the timer of the current invocation. The caller must
+// hold s.mu.
+func (s *Server) disarmDeadline() {
+	if s.deadline != nil {
+		s.deadline.Stop()
+		s.deadline = nil
+	}
+}
+
+// expire answers the invocation with the error Lambda returns on timeouts.
+func (s *Server) expire(inv *invocation.Invocation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inv != inv {
+		return
+	}
+
+	log.Printf("[%s] invocation [%s] timed out after %s", s.id, inv.ID, s.cfg.LambdaRuntimeDeadline)
+	s.abort(telemetry.StatusTimeout, &invocation.FunctionError{
+		ErrorMessage: fmt.Sprintf("RequestId: %s Error: Task timed out after %.2f seconds", inv.ID, s.cfg.LambdaRuntimeDeadline.Seconds()),
+		ErrorType:    ErrorTypeTimedOut,
+	}, ErrTimeout)
+}
+
+// Fail answers the invocation in progress, if any, with the error of the
+// execution environment.
+func (s *Server) Fail(fnErr *invocation.FunctionError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inv == nil {
+		return
+	}
+
+	log.Printf("[%s] invocation [%s] failed: %s", s.id, s.inv.ID, fnErr)
+	s.abort(telemetry.StatusFailure, fnErr, &RuntimeError{Err: fnErr})
+}
+
+// abort completes the current invocation without the runtime, unless the
+// runtime is already sending its response. The caller must hold s.mu.
+func (s *Server) abort(status string, fnErr *invocation.FunctionError, err error) {
+	inv := s.inv
+
+	select {
+	case <-s.nextCh:
+	default:
+	}
+
+	delivered := s.state == busy || s.state == responding
+	if delivered {
+		s.reportInvocationDone(status, 0)
+	}
+
+	if s.state != responding {
+		inv.ResponseCh <- invocation.ResponseFunctionError(fnErr)
+		close(inv.ResponseCh)
+	}
+
+	if delivered {
+		s.state = idle
+	}
+
+	s.disarmDeadline()
+	s.inv = nil
+	s.completedID = inv.ID.String()
+	s.doneCh <- err
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// Event stream framing used by InvokeWithResponseStream, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/RESTSelectObjectAppendix.html
+const (
+	ContentTypeEventStream = "application/vnd.amazon.eventstream"
+
+	eventTypePayloadChunk   = "PayloadChunk"
+	eventTypeInvokeComplete = "InvokeComplete"
+
+	headerValueTypeString = 7
+	preludeLength         = 12
+	checksumLength        = 4
+)
+
+type invokeComplete struct {
+	ErrorCode    string `json:"ErrorCode,omitempty"`
+	ErrorDetails string `json:"ErrorDetails,omitempty"`
+	LogResult    string `json:"LogResult,omitempty"`
+}
+
+func writeEvent(w io.Writer, eventType string, contentType string, payload []byte) error {
+	var headers []byte
+	headers = appendHeader(headers, ":event-type", eventType)
+	headers = appendHeader(headers, ":content-type", contentType)
+	headers = appendHeader(headers, ":message-type", "event")
+
+	totalLength := preludeLength + len(headers) + len(payload) + checksumLength
+	message := make([]byte, 0, totalLength)
+	message = binary.BigEndian.AppendUint32(message, uint32(totalLength))
+	message = binary.BigEndian.AppendUint32(message, uint32(len(headers)))
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+	message = append(message, headers...)
+	message = append(message, payload...)
+	message = binary.BigEndian.AppendUint32(message, crc32.ChecksumIEEE(message))
+
+	_, err := w.Write(message)
+	return err
+}
+
+func appendHeader(buf []byte, name string, value string) []byte {
+	buf = append(buf, byte(len(name)))
+	buf = append(buf, name...)
+	buf = append(buf, headerValueTypeString)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	return buf
+}
@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"sync"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/kbertalan/crie/internal/config"
 	"github.com/kbertalan/crie/internal/invocation"
+	"github.com/kbertalan/crie/internal/sender"
 )
 
 func ListenAndServe(ctx context.Context, cfg config.Config, wg *sync.WaitGroup, cancel context.CancelFunc, invocationCh chan<- invocation.Invocation) {
@@ -24,6 +27,13 @@ func ListenAndServe(ctx context.Context, cfg config.Config, wg *sync.WaitGroup,
 		cfg:          cfg,
 	})
 
+	streamingPattern := fmt.Sprintf("POST /2021-11-15/functions/%s/response-streaming-invocations", cfg.LambdaName)
+	handler.Handle(streamingPattern, &invokeHandler{
+		invocationCh: invocationCh,
+		cfg:          cfg,
+		streaming:    true,
+	})
+
 	srv := http.Server{
 		Addr:    string(cfg.ServerAddress),
 		Handler: handler,
@@ -49,11 +59,19 @@ func ListenAndServe(ctx context.Context, cfg config.Config, wg *sync.WaitGroup,
 type invokeHandler struct {
 	invocationCh chan<- invocation.Invocation
 	cfg          config.Config
+	streaming    bool
 }
 
 func (h *invokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	inv, err := invocation.FromHTTPRequest(r, h.cfg.MaxBodySize)
 	if err != nil {
+		var requestErr *invocation.RequestError
+		if errors.As(err, &requestErr) {
+			w.Header().Set("X-Amzn-ErrorType", requestErr.Type)
+			sender.SendMessage(w, http.StatusBadRequest, "%s", requestErr.Message)
+			return
+		}
+
 		log.Printf("cannot construct invocation from request: %+v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -74,14 +92,23 @@ func (h *invokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set(invocation.XAmznTraceId, inv.TraceID)
+
 	if inv.IsEvent() {
 		w.WriteHeader(http.StatusAccepted)
-		go h.getResponse(inv)
+		go func() {
+			h.getResponse(inv).Buffered()
+		}()
 		return
 	}
 
 	response := h.getResponse(inv)
+	if h.streaming && response.StatusCode == http.StatusOK {
+		h.writeStream(w, response)
+		return
+	}
 
+	response = response.Buffered()
 	for name, values := range response.Header {
 		w.Header().Del(name)
 		for _, value := range values {
@@ -93,30 +120,89 @@ func (h *invokeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(response.Body)
 }
 
+// getResponse waits for the response of the invocation. The deadline of the
+// invocation is enforced by the rapi.Server, which answers timed out
+// invocations with the timeout error of Lambda.
 func (h *invokeHandler) getResponse(inv invocation.Invocation) invocation.Response {
-	select {
-	case response, ok := <-inv.ResponseCh:
-		if !ok {
-			log.Printf("[%s]: reponse channel was closed unexpectedly", inv.ID)
-			return invocation.Response{
-				StatusCode: http.StatusInternalServerError,
-			}
+	response, ok := <-inv.ResponseCh
+	if !ok {
+		log.Printf("[%s]: reponse channel was closed unexpectedly", inv.ID)
+		return invocation.Response{
+			StatusCode: http.StatusInternalServerError,
 		}
+	}
 
-		if err := response.Error; err != nil {
-			log.Printf("[%s]: processing request failed: %+v", inv.ID, err)
+	if err := response.Error; err != nil {
+		log.Printf("[%s]: processing request failed: %+v", inv.ID, err)
+	}
+	return response
+}
+
+// writeStream sends the response to the client as an event stream, forwarding
+// the chunks of a streamed response as soon as they arrive.
+func (h *invokeHandler) writeStream(w http.ResponseWriter, response invocation.Response) {
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	writeChunk := func(chunk []byte) error {
+		if err := writeEvent(w, eventTypePayloadChunk, "application/octet-stream", chunk); err != nil {
+			return err
 		}
-		return response
-	case <-time.After(h.cfg.LambdaRuntimeDeadline):
-		go func() {
-			select {
-			case <-inv.ResponseCh:
-			case <-time.After(h.cfg.LambdaRuntimeDeadline):
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	var complete invokeComplete
+	var fnErr *invocation.FunctionError
+	if errors.As(response.Error, &fnErr) {
+		complete.ErrorCode = fnErr.ErrorType
+		complete.ErrorDetails = string(response.Body)
+	} else if response.Stream == nil {
+		if err := writeChunk(response.Body); err != nil {
+			log.Printf("cannot write response stream: %+v", err)
+			return
+		}
+	} else {
+		defer response.Stream.Close()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := response.Stream.Read(buf)
+			if n > 0 {
+				if writeErr := writeChunk(buf[:n]); writeErr != nil {
+					log.Printf("cannot write response stream: %+v", writeErr)
+					return
+				}
 			}
-		}()
 
-		resp := invocation.ResponseMessage(http.StatusBadGateway, "lambda timeout after %s", h.cfg.LambdaRuntimeDeadline)
-		resp.Error = fmt.Errorf("lambda timeout after %s", h.cfg.LambdaRuntimeDeadline)
-		return resp
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				var streamErr *invocation.StreamError
+				if errors.As(err, &streamErr) {
+					complete.ErrorCode = streamErr.Type
+					complete.ErrorDetails = string(streamErr.Body)
+				} else {
+					complete.ErrorCode = "Runtime.StreamError"
+					complete.ErrorDetails = err.Error()
+				}
+				break
+			}
+		}
+	}
+
+	payload, _ := json.Marshal(complete)
+	if err := writeEvent(w, eventTypeInvokeComplete, "application/json", payload); err != nil {
+		log.Printf("cannot write response stream completion: %+v", err)
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
 	}
 }
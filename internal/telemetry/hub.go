@@ -0,0 +1,187 @@
+package telemetry
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypePlatformInitStart   = "platform.initStart"
+	TypePlatformStart       = "platform.start"
+	TypePlatformRuntimeDone = "platform.runtimeDone"
+	TypePlatformReport      = "platform.report"
+	TypeFunction            = "function"
+	TypeExtension           = "extension"
+
+	CategoryPlatform  = "platform"
+	CategoryFunction  = "function"
+	CategoryExtension = "extension"
+
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+	maxBacklogSize = 1000
+)
+
+type Event struct {
+	Time   string `json:"time"`
+	Type   string `json:"type"`
+	Record any    `json:"record"`
+}
+
+// Category returns the subscription category of the event, which is the part
+// of the type before the first dot.
+func (e Event) Category() string {
+	category, _, _ := strings.Cut(e.Type, ".")
+	return category
+}
+
+// Hub collects the telemetry of one execution environment and delivers it to
+// the subscribers. Events published during initialization are kept until the
+// first invocation starts, so extensions subscribing during init receive them
+// as well.
+type Hub struct {
+	mu sync.Mutex
+
+	id          string
+	subscribers map[string]*subscriber
+	backlog     []Event
+	buffering   bool
+	holding     bool
+}
+
+func NewHub(id string) *Hub {
+	return &Hub{
+		id:          id,
+		subscribers: make(map[string]*subscriber),
+		buffering:   true,
+	}
+}
+
+func (h *Hub) Publish(eventType string, record any) {
+	event := Event{
+		Time:   time.Now().UTC().Format(timeFormat),
+		Type:   eventType,
+		Record: record,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if eventType == TypePlatformStart {
+		h.buffering = false
+		h.backlog = nil
+	}
+
+	if h.buffering && len(h.backlog) < maxBacklogSize {
+		h.backlog = append(h.backlog, event)
+	}
+
+	for _, sub := range h.subscribers {
+		sub.send(event)
+	}
+}
+
+// Subscribe registers a subscription under the given key, replacing any
+// previous subscription with the same key.
+func (h *Hub) Subscribe(key string, subscription Subscription) {
+	sub := newSubscriber(h.id, subscription)
+
+	h.mu.Lock()
+	if h.holding {
+		sub.hold()
+	}
+	previous := h.subscribers[key]
+	h.subscribers[key] = sub
+	for _, event := range h.backlog {
+		sub.send(event)
+	}
+	h.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+
+	go sub.run()
+}
+
+// Hold stops delivering events to the subscribers while the execution
+// environment is frozen, as the extensions could not receive them. Events are
+// kept and delivered once Release is called.
+func (h *Hub) Hold() {
+	h.mu.Lock()
+	h.holding = true
+	subscribers := slices.Collect(maps.Values(h.subscribers))
+	h.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.hold()
+	}
+}
+
+// Release delivers the events kept since Hold.
+func (h *Hub) Release() {
+	h.mu.Lock()
+	h.holding = false
+	subscribers := slices.Collect(maps.Values(h.subscribers))
+	h.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.release()
+	}
+}
+
+// Reset flushes and removes all subscribers and starts buffering again, as a
+// new execution environment is about to be initialized.
+func (h *Hub) Reset() {
+	h.mu.Lock()
+	subscribers := h.subscribers
+	h.subscribers = make(map[string]*subscriber)
+	h.backlog = nil
+	h.buffering = true
+	h.holding = false
+	h.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.close()
+	}
+}
+
+// Writer returns a writer publishing every written line as an event of the
+// given type.
+func (h *Hub) Writer(eventType string) io.Writer {
+	return &lineWriter{
+		hub:       h,
+		eventType: eventType,
+	}
+}
+
+type lineWriter struct {
+	hub       *Hub
+	eventType string
+	buf       []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimSuffix(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		w.hub.Publish(w.eventType, line)
+	}
+
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+
+	return len(p), nil
+}
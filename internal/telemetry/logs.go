@@ -0,0 +1,56 @@
+package telemetry
+
+const (
+	TypePlatformEnd = "platform.end"
+)
+
+type PlatformEnd struct {
+	RequestID string `json:"requestId"`
+}
+
+type LogsReportMetrics struct {
+	DurationMs       float64  `json:"durationMs"`
+	BilledDurationMs int64    `json:"billedDurationMs"`
+	MemorySizeMB     uint32   `json:"memorySizeMB"`
+	MaxMemoryUsedMB  uint64   `json:"maxMemoryUsedMB"`
+	InitDurationMs   *float64 `json:"initDurationMs,omitempty"`
+}
+
+type LogsPlatformReport struct {
+	RequestID string            `json:"requestId"`
+	Metrics   LogsReportMetrics `json:"metrics"`
+}
+
+// LogsAPIEvent converts an event to the schema of the Logs API (2020-08-15),
+// which predates the Telemetry API and knows only a subset of its platform
+// events.
+func LogsAPIEvent(event Event) (Event, bool) {
+	switch record := event.Record.(type) {
+	case PlatformStart:
+		return event, true
+	case PlatformRuntimeDone:
+		event.Type = TypePlatformEnd
+		event.Record = PlatformEnd{
+			RequestID: record.RequestID,
+		}
+		return event, true
+	case PlatformReport:
+		event.Record = LogsPlatformReport{
+			RequestID: record.RequestID,
+			Metrics: LogsReportMetrics{
+				DurationMs:       record.Metrics.DurationMs,
+				BilledDurationMs: record.Metrics.BilledDurationMs,
+				MemorySizeMB:     record.Metrics.MemorySizeMB,
+				MaxMemoryUsedMB:  record.Metrics.MaxMemoryUsedMB,
+				InitDurationMs:   record.Metrics.InitDurationMs,
+			},
+		}
+		return event, true
+	}
+
+	if event.Category() == CategoryPlatform {
+		return event, false
+	}
+
+	return event, true
+}
@@ -0,0 +1,63 @@
+package telemetry
+
+const (
+	TraceTypeXRay = "X-Amzn-Trace-Id"
+
+	InitializationTypeOnDemand = "on-demand"
+	PhaseInit                  = "init"
+
+	StatusSuccess = "success"
+	StatusError   = "error"
+	StatusFailure = "failure"
+	StatusTimeout = "timeout"
+)
+
+type PlatformInitStart struct {
+	InitializationType string `json:"initializationType"`
+	Phase              string `json:"phase"`
+	FunctionName       string `json:"functionName"`
+	FunctionVersion    string `json:"functionVersion"`
+}
+
+type TraceContext struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func XRayTraceContext(value string) *TraceContext {
+	return &TraceContext{
+		Type:  TraceTypeXRay,
+		Value: value,
+	}
+}
+
+type PlatformStart struct {
+	RequestID string        `json:"requestId"`
+	Version   string        `json:"version"`
+	Tracing   *TraceContext `json:"tracing,omitempty"`
+}
+
+type PlatformRuntimeDone struct {
+	RequestID string             `json:"requestId"`
+	Status    string             `json:"status"`
+	Metrics   RuntimeDoneMetrics `json:"metrics"`
+}
+
+type RuntimeDoneMetrics struct {
+	DurationMs    float64 `json:"durationMs"`
+	ProducedBytes int     `json:"producedBytes"`
+}
+
+type PlatformReport struct {
+	RequestID string        `json:"requestId"`
+	Status    string        `json:"status"`
+	Metrics   ReportMetrics `json:"metrics"`
+}
+
+type ReportMetrics struct {
+	DurationMs       float64  `json:"durationMs"`
+	BilledDurationMs int64    `json:"billedDurationMs"`
+	MemorySizeMB     uint32   `json:"memorySizeMB"`
+	MaxMemoryUsedMB  uint64   `json:"maxMemoryUsedMB"`
+	InitDurationMs   *float64 `json:"initDurationMs,omitempty"`
+}
@@ -0,0 +1,243 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolHTTP = "HTTP"
+
+	MinMaxItems  = 1000
+	MaxMaxItems  = 10000
+	MinMaxBytes  = 256 * 1024
+	MaxMaxBytes  = 1024 * 1024
+	MinTimeoutMs = 25
+	MaxTimeoutMs = 30000
+
+	// sandboxHostname is how extensions address themselves in a Lambda
+	// execution environment.
+	sandboxHostname = "sandbox.localdomain"
+
+	deliveryTimeout = 5 * time.Second
+)
+
+type Buffering struct {
+	MaxItems  int `json:"maxItems"`
+	MaxBytes  int `json:"maxBytes"`
+	TimeoutMs int `json:"timeoutMs"`
+}
+
+func (b Buffering) Validate() error {
+	if b.MaxItems < MinMaxItems || b.MaxItems > MaxMaxItems {
+		return fmt.Errorf("buffering.maxItems must be between %d and %d, but it was %d", MinMaxItems, MaxMaxItems, b.MaxItems)
+	}
+
+	if b.MaxBytes < MinMaxBytes || b.MaxBytes > MaxMaxBytes {
+		return fmt.Errorf("buffering.maxBytes must be between %d and %d, but it was %d", MinMaxBytes, MaxMaxBytes, b.MaxBytes)
+	}
+
+	if b.TimeoutMs < MinTimeoutMs || b.TimeoutMs > MaxTimeoutMs {
+		return fmt.Errorf("buffering.timeoutMs must be between %d and %d, but it was %d", MinTimeoutMs, MaxTimeoutMs, b.TimeoutMs)
+	}
+
+	return nil
+}
+
+type Subscription struct {
+	Categories []string
+	Buffering  Buffering
+	URI        string
+
+	// Convert adapts events to the schema of the subscribed API, dropping
+	// the ones returning false. Events are delivered as is when it is nil.
+	Convert func(Event) (Event, bool)
+}
+
+// DestinationURI validates the destination of a subscription and rewrites the
+// Lambda sandbox hostname, which does not resolve outside of AWS, to localhost.
+func DestinationURI(protocol string, uri string) (string, error) {
+	if protocol != ProtocolHTTP {
+		return "", fmt.Errorf("unsupported destination protocol: %s", protocol)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "http" {
+		return "", fmt.Errorf("unsupported destination URI scheme: %s", u.Scheme)
+	}
+
+	if u.Hostname() == sandboxHostname {
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort("localhost", port)
+		} else {
+			u.Host = "localhost"
+		}
+	}
+
+	return u.String(), nil
+}
+
+type subscriber struct {
+	id           string
+	subscription Subscription
+	client       *http.Client
+	eventCh      chan Event
+	doneCh       chan struct{}
+
+	// mu is held while a batch is delivered, so holding the subscriber waits
+	// for the delivery in progress.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	holding bool
+}
+
+func newSubscriber(id string, subscription Subscription) *subscriber {
+	s := &subscriber{
+		id:           id,
+		subscription: subscription,
+		client:       &http.Client{Timeout: deliveryTimeout},
+		eventCh:      make(chan Event, subscription.Buffering.MaxItems),
+		doneCh:       make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// send must be called with the hub lock held, which guarantees that the
+// channel is not closed concurrently.
+func (s *subscriber) send(event Event) {
+	if !slices.Contains(s.subscription.Categories, event.Category()) {
+		return
+	}
+
+	if convert := s.subscription.Convert; convert != nil {
+		var ok bool
+		if event, ok = convert(event); !ok {
+			return
+		}
+	}
+
+	select {
+	case s.eventCh <- event:
+	default:
+		log.Printf("[%s] telemetry subscriber %s is lagging behind, dropping %s event", s.id, s.subscription.URI, event.Type)
+	}
+}
+
+// hold keeps batches from being delivered until release is called, waiting
+// for the delivery in progress, if any. The destination is served by a frozen
+// extension meanwhile, which could not accept them.
+func (s *subscriber) hold() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holding = true
+}
+
+func (s *subscriber) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holding = false
+	s.cond.Broadcast()
+}
+
+func (s *subscriber) close() {
+	s.release()
+	close(s.eventCh)
+	<-s.doneCh
+}
+
+func (s *subscriber) run() {
+	defer close(s.doneCh)
+
+	timeout := time.Duration(s.subscription.Buffering.TimeoutMs) * time.Millisecond
+	timer := time.NewTimer(timeout)
+	timer.Stop()
+
+	var batch []json.RawMessage
+	size := 0
+	flush := func() {
+		timer.Stop()
+		if len(batch) == 0 {
+			return
+		}
+
+		s.deliver(batch)
+		batch = nil
+		size = 0
+	}
+
+	for {
+		select {
+		case event, ok := <-s.eventCh:
+			if !ok {
+				flush()
+				return
+			}
+
+			encoded, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("[%s] telemetry event %s cannot be encoded: %+v", s.id, event.Type, err)
+				continue
+			}
+
+			if size+len(encoded) > s.subscription.Buffering.MaxBytes {
+				flush()
+			}
+
+			if len(batch) == 0 {
+				timer.Reset(timeout)
+			}
+
+			batch = append(batch, encoded)
+			size += len(encoded)
+
+			if len(batch) >= s.subscription.Buffering.MaxItems {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+func (s *subscriber) deliver(batch []json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.holding {
+		s.cond.Wait()
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("[%s] telemetry batch cannot be encoded: %+v", s.id, err)
+		return
+	}
+
+	resp, err := s.client.Post(s.subscription.URI, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[%s] telemetry delivery to %s failed: %+v", s.id, s.subscription.URI, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("[%s] telemetry delivery to %s returned status %d", s.id, s.subscription.URI, resp.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+package watcher
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// skippedDirs are dependency and cache directories, which are large and change
+// by tools rather than by editing the function.
+var skippedDirs = []string{"node_modules", "vendor", "__pycache__", "target"}
+
+// Watch polls the files under the paths and calls changed once they were
+// modified, added or removed, and stayed unchanged for an interval, so a build
+// writing many files triggers it only once. Changes made while changed runs
+// are reported by the next call.
+func Watch(ctx context.Context, paths []string, interval time.Duration, changed func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := fingerprint(paths)
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := fingerprint(paths)
+			if current != last {
+				last = current
+				pending = true
+				continue
+			}
+
+			if pending {
+				pending = false
+				changed()
+			}
+		}
+	}
+}
+
+// fingerprint hashes the name, size and modification time of every file
+// under the paths. Missing paths are skipped, so creating them is a change.
+// Hidden and dependency directories below the paths are not walked, as every
+// poll would read them entirely; they can be watched by listing them.
+func fingerprint(paths []string) uint64 {
+	hash := fnv.New64a()
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if entry.IsDir() && path != root && skipped(entry.Name()) {
+				return filepath.SkipDir
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+
+			hash.Write([]byte(path))
+			binary.Write(hash, binary.LittleEndian, info.Size())
+			binary.Write(hash, binary.LittleEndian, info.ModTime().UnixNano())
+			return nil
+		})
+	}
+
+	return hash.Sum64()
+}
+
+func skipped(dir string) bool {
+	return strings.HasPrefix(dir, ".") || slices.Contains(skippedDirs, dir)
+}